@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression
+//
+// Chunks of files with a file key are compressed before they are sealed when
+// the file asks for it. The algorithm is kept in the top 4 bits of the slot
+// length and, when it is not none, at the end of the associated data, so it
+// can not be changed unnoticed. A chunk that does not get at least 1/32
+// smaller is stored as it is, so incompressible data costs nothing on read.
+// Since format 13 a slot is just as long as the compressed chunk, see
+// ffs_slots.go. Older files keep slots of a fixed size, there the space a
+// compressed chunk saves is the unwritten end of its slot, a hole only when
+// the shard file system is sparse.
+// New writes use the algorithm of the user.ffs.compress xattr of the file or
+// of the nearest folder above it that has one, else the one of the volume
+// (--compress). The xattr takes none, gzip or zstd.
+
+const (
+	compressNone byte = 0
+	compressGzip byte = 1
+	compressZstd byte = 2
+
+	compressXattr = "user.ffs.compress"
+	slotLenBits   = 28 // the low bits of the slot length are the length, the rest the algorithm
+)
+
+var compressionNames = []string{"none", "gzip", "zstd"}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compressionByName returns the algorithm called name.
+func compressionByName(name string) (byte, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range compressionNames {
+		if n == name {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %s, use none, gzip or zstd", name)
+}
+
+// compressChunk compresses chunk with algo and returns the algorithm that was
+// used, none when it does not pay off.
+func compressChunk(algo byte, chunk []byte) (byte, []byte) {
+	var out []byte
+	switch algo {
+	case compressGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(chunk)
+		w.Close()
+		out = buf.Bytes()
+	case compressZstd:
+		out = zstdEncoder.EncodeAll(chunk, nil)
+	default:
+		return compressNone, chunk
+	}
+	if len(out) >= len(chunk)-len(chunk)/32 {
+		return compressNone, chunk
+	}
+	return algo, out
+}
+
+// decompressChunk reverses compressChunk.
+func decompressChunk(algo byte, b []byte) ([]byte, error) {
+	switch algo {
+	case compressNone:
+		return b, nil
+	case compressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case compressZstd:
+		return zstdDecoder.DecodeAll(b, nil)
+	}
+	return nil, fmt.Errorf("unknown compression %d", algo)
+}
+
+// compressionFor returns the algorithm new writes to path use.
+func (fs *ffs) compressionFor(path string) byte {
+	for p := path; ; p = filepath.Dir(p) {
+		var value []byte
+		if fs.DB.QueryRow("select value from items_ex where fullpath=? and name=?", p, compressXattr).Scan(&value) == nil {
+			if algo, err := compressionByName(string(value)); err == nil {
+				return algo
+			}
+		}
+		if p == "/" || p == "." {
+			return fs.compress
+		}
+	}
+}
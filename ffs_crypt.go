@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// File encryption
+//
+// Every file written since format 5 has a random data key of its own. It is
+// kept in items.filekey, sealed with AES-256-GCM under a key derived from the
+// data key of the key set the file is written with. The chunks of the file are
+// sealed with AES-256-GCM under the file key, a random nonce is stored in front
+// of each chunk and the associated data binds the chunk to its place:
+//
+//	0   8  rowid of the file
+//	8   2  shard index, data shards first
+//	10  8  stripe index
+//	18  1  compression, only when the chunk is compressed
+//
+// items.format is the format version the chunks of a file are sealed with.
+// Files of format 5 have the rowid and the shard index only and are not
+// compressed, they keep that until a rekey writes them again.
+//
+// Every chunk is sealed on its own, so any range of a file is read or written
+// without touching the rest. A chunk that was altered, or swapped in from
+// another file, shard or stripe, fails the authentication and is rebuilt from
+// parity like a missing one. A chunk must open to exactly the length the size
+// of the file gives it and a shard file that ends before the last stripe of
+// the file is reported as truncated, so cutting a file short is detected too.
+// Files without a file key keep the nlib encryption with the keys of their
+// key set until they are written again by convertFile or a rekey.
+
+const (
+	fileKeySize    = 32
+	stripeADFormat = 6 // first format with the stripe index in the associated data
+)
+
+var errChunkAuth = errors.New("chunk does not authenticate")
+
+// fileCrypt seals and opens the chunks of one file.
+type fileCrypt struct {
+	rowid    uint64
+	keys     volumeKeys  // key set of the file, seals the chunks of files without a file key
+	aead     cipher.AEAD // AES-256-GCM with the file key, nil for those files
+	wrapped  []byte      // the file key sealed for items.filekey
+	overhead int         // bytes a sealed chunk is longer than the chunk
+	data     int         // number of data shards, the others are parity
+	compress byte        // compression of new chunks
+	format   int         // format version the chunks are sealed with, see ad
+}
+
+// fileKeyKey derives the key that wraps file keys from the data key of keys.
+func fileKeyKey(keys volumeKeys) []byte {
+	mac := hmac.New(sha256.New, keys.data)
+	mac.Write([]byte("file key"))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newFileCrypt gives file rowid a new random file key under keys.
+func (fs *ffs) newFileCrypt(rowid uint64, keys volumeKeys) (*fileCrypt, error) {
+	key := make([]byte, fileKeySize)
+	readRandom(key)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCrypt{rowid: rowid, keys: keys, aead: aead, wrapped: sealKey(fileKeyKey(keys), key), overhead: aead.NonceSize() + aead.Overhead(), data: fs.dataShards, format: formatVersion}, nil
+}
+
+// fileCrypt returns the encryption of file rowid written with key set gen,
+// wrapped is its items.filekey and format its items.format.
+func (fs *ffs) fileCrypt(rowid uint64, gen int, wrapped []byte, format int) (*fileCrypt, error) {
+	keys, err := fs.ring.get(gen)
+	if err != nil {
+		return nil, err
+	}
+	if wrapped == nil {
+		return &fileCrypt{rowid: rowid, keys: keys, overhead: fs.sealOverhead, data: fs.dataShards}, nil
+	}
+	key, err := openKey(fileKeyKey(keys), wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("file key of %d does not open", rowid)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if format == 0 {
+		format = formatVersion
+	}
+	return &fileCrypt{rowid: rowid, keys: keys, aead: aead, wrapped: wrapped, overhead: aead.NonceSize() + aead.Overhead(), data: fs.dataShards, format: format}, nil
+}
+
+// cryptOf returns the encryption of a stored file.
+func (fs *ffs) cryptOf(f storedFile) (*fileCrypt, error) {
+	fc, err := fs.fileCrypt(f.rowid, f.keyGen, f.fileKey, f.format)
+	if err != nil {
+		return nil, err
+	}
+	fc.compress = fs.compressionFor(f.fullpath)
+	return fc, nil
+}
+
+// ad is the associated data of chunk s of stripe n compressed with algo.
+func (fc *fileCrypt) ad(s int, n int64, algo byte) []byte {
+	if fc.format < stripeADFormat {
+		ad := make([]byte, 10)
+		binary.BigEndian.PutUint64(ad, fc.rowid)
+		binary.BigEndian.PutUint16(ad[8:], uint16(s))
+		return ad
+	}
+	ad := make([]byte, 18, 19)
+	binary.BigEndian.PutUint64(ad, fc.rowid)
+	binary.BigEndian.PutUint16(ad[8:], uint16(s))
+	binary.BigEndian.PutUint64(ad[10:], uint64(n))
+	if algo != compressNone {
+		ad = append(ad, algo)
+	}
+	return ad
+}
+
+// seal compresses and encrypts chunk s of stripe n, it returns the
+// compression that was used.
+func (fc *fileCrypt) seal(s int, n int64, chunk []byte) (byte, []byte) {
+	if fc.aead == nil {
+		if s < fc.data {
+			return compressNone, nlib.Encrypt(chunk, fc.keys.data)
+		}
+		return compressNone, nlib.Encrypt(chunk, fc.keys.sum)
+	}
+	compress := fc.compress
+	if fc.format < stripeADFormat {
+		compress = compressNone
+	}
+	algo, chunk := compressChunk(compress, chunk)
+	nonce := make([]byte, fc.aead.NonceSize(), fc.aead.NonceSize()+len(chunk)+fc.aead.Overhead())
+	readRandom(nonce)
+	return algo, fc.aead.Seal(nonce, nonce, chunk, fc.ad(s, n, algo))
+}
+
+// open decrypts and decompresses chunk s of stripe n.
+func (fc *fileCrypt) open(s int, n int64, algo byte, sealed []byte) ([]byte, error) {
+	if fc.aead == nil {
+		if algo != compressNone {
+			return nil, fmt.Errorf("compressed chunk in a file without a file key")
+		}
+		if s < fc.data {
+			return nlib.Decrypt(sealed, fc.keys.data), nil
+		}
+		return nlib.Decrypt(sealed, fc.keys.sum), nil
+	}
+	ns := fc.aead.NonceSize()
+	if len(sealed) < ns+fc.aead.Overhead() {
+		return nil, errChunkAuth
+	}
+	chunk, err := fc.aead.Open(nil, sealed[:ns], sealed[ns:], fc.ad(s, n, algo))
+	if err != nil {
+		return nil, errChunkAuth
+	}
+	return decompressChunk(algo, chunk)
+}
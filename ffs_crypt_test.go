@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func newTestCrypt(t *testing.T, rowid uint64) (*ffs, *fileCrypt) {
+	fs := &ffs{ring: keyRing{randomKeys(1)}, dataShards: 2}
+	fc, err := fs.newFileCrypt(rowid, fs.currentKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, fc
+}
+
+// TestChunkFraming seals a chunk as nonce, ciphertext and tag under the file
+// key and opens it with the key unwrapped from items.filekey.
+func TestChunkFraming(t *testing.T) {
+	fs, fc := newTestCrypt(t, 7)
+	chunk := make([]byte, 1000)
+	rand.Read(chunk)
+	algo, sealed := fc.seal(1, 0, chunk)
+	if algo != compressNone || len(sealed) != len(chunk)+fc.overhead || fc.overhead != 12+16 {
+		t.Fatalf("sealed %d bytes with overhead %d", len(sealed), fc.overhead)
+	}
+	if _, again := fc.seal(1, 0, chunk); bytes.Equal(again[:12], sealed[:12]) {
+		t.Fatal("nonce is reused")
+	}
+	if bytes.Contains(sealed, chunk[:32]) {
+		t.Fatal("chunk is not encrypted")
+	}
+	opened, err := fs.fileCrypt(7, 1, fc.wrapped, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := opened.open(1, 0, algo, sealed); err != nil || !bytes.Equal(got, chunk) {
+		t.Fatal("open", err)
+	}
+	if _, err := fs.fileCrypt(7, 1, append([]byte{}, fc.wrapped[1:]...), 0); err == nil {
+		t.Fatal("altered file key opens")
+	}
+}
+
+// TestChunkTamper checks that an altered chunk, a chunk of another file or
+// shard and a cut chunk do not open.
+func TestChunkTamper(t *testing.T) {
+	fs, fc := newTestCrypt(t, 7)
+	chunk := []byte("the content of a chunk")
+	algo, sealed := fc.seal(0, 0, chunk)
+	for i := range sealed {
+		bad := append([]byte{}, sealed...)
+		bad[i] ^= 1
+		if _, err := fc.open(0, 0, algo, bad); err != errChunkAuth {
+			t.Fatalf("bit flip at %d: %v", i, err)
+		}
+	}
+	if _, err := fc.open(1, 0, algo, sealed); err != errChunkAuth {
+		t.Fatal("chunk of another shard opens", err)
+	}
+	other, err := fs.fileCrypt(8, 1, fc.wrapped, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.open(0, 0, algo, sealed); err != errChunkAuth {
+		t.Fatal("chunk of another file opens", err)
+	}
+	for _, n := range []int{0, 10, len(sealed) - 1} {
+		if _, err := fc.open(0, 0, algo, sealed[:n]); err != errChunkAuth {
+			t.Fatalf("chunk cut to %d bytes: %v", n, err)
+		}
+	}
+}
+
+// TestChunkAD checks that a chunk opens only at its stripe and with its
+// compression, while files of format 5 keep their shorter associated data.
+func TestChunkAD(t *testing.T) {
+	fs, fc := newTestCrypt(t, 7)
+	fc.compress = compressGzip
+	chunk := bytes.Repeat([]byte("stripe "), 200)
+	algo, sealed := fc.seal(0, 3, chunk)
+	if algo != compressGzip || len(fc.ad(0, 3, algo)) != 19 || len(fc.ad(0, 3, compressNone)) != 18 {
+		t.Fatal("associated data", algo)
+	}
+	if got, err := fc.open(0, 3, algo, sealed); err != nil || !bytes.Equal(got, chunk) {
+		t.Fatal("open", err)
+	}
+	if _, err := fc.open(0, 4, algo, sealed); err != errChunkAuth {
+		t.Fatal("chunk of another stripe opens", err)
+	}
+	if _, err := fc.open(0, 3, compressNone, sealed); err != errChunkAuth {
+		t.Fatal("chunk opens as uncompressed", err)
+	}
+
+	old, err := fs.fileCrypt(7, 1, fc.wrapped, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.compress = compressGzip
+	algo, sealed = old.seal(0, 3, chunk)
+	if algo != compressNone || len(old.ad(0, 3, algo)) != 10 {
+		t.Fatal("format 5 chunk", algo)
+	}
+	if got, err := old.open(0, 9, algo, sealed); err != nil || !bytes.Equal(got, chunk) {
+		t.Fatal("format 5 chunk does not open", err)
+	}
+	if _, err := fc.open(0, 3, algo, sealed); err != errChunkAuth {
+		t.Fatal("format 5 chunk opens with the stripe index", err)
+	}
+}
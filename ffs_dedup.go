@@ -0,0 +1,650 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"log"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Deduplication
+//
+// With dedup on (--dedup) a file that was written is queued in the dedups
+// table when it is released, and the dedup worker cuts it in content defined
+// chunks in the background: a gear hash over the bytes picks the cut points,
+// so an insert only changes the chunks around it and copies of the same data
+// give the same chunks. Every distinct chunk is stored once as a chunk
+// object, a hidden file of a single stripe with a file key of its own and the
+// fullpath chunkFolder+hash. The chunks table finds a chunk by a keyed hash
+// of its content, HMAC-SHA256 under a key derived from the data key of a key
+// set, so the database tells nothing about the content to whoever does not
+// have the keys. The manifests table lists the chunks of a file by their
+// offset and chunks.refs counts those references. The shards of the file are
+// removed once its manifest is written, and a chunk object is removed with
+// the last reference to it. The worker holds fs.lock only for a chunk at a
+// time, a file that is opened or changed meanwhile is done again later.
+//
+// A manifest file has no shards and no file key. A write to it reads the
+// chunks it falls in, and on flush those are cut again and replace the old
+// ones in the manifest, the rest of the file keeps its chunks. Truncate cuts
+// only the chunk the new end falls in. Chunk objects are ordinary files to
+// scrub, rebuild and rekey, a rekey hashes them again with the new keys. The
+// gc command runs the queue and counts the references again, it removes what
+// an interrupted dedup left behind.
+
+const (
+	chunkParent = -2        // parentid of chunk objects, they are in no folder
+	chunkFolder = "chunks/" // fullpath prefix of chunk objects, FUSE paths start with /
+)
+
+// dedupInterval is how often the dedup worker looks at the queue.
+const dedupInterval = 10 * time.Second
+
+// maxEditChunks bounds the bytes of a manifest file that are written before
+// they are cut in chunks, in chunks of the largest size.
+const maxEditChunks = 16
+
+// gearTable drives the rolling hash that picks the cut points, it is the
+// same for every volume.
+var gearTable [256]uint64
+
+func init() {
+	x := uint64(0x6666735f64656475)
+	for i := range gearTable {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gearTable[i] = z ^ z>>31
+	}
+}
+
+// maxDedupChunk is the largest chunk, one stripe, so every chunk object is a
+// single stripe. The smallest chunk is an eighth of it and the chunks are
+// about 3/8 of it on average.
+func (fs *ffs) maxDedupChunk() int {
+	return int(fs.stripeWidth(fs.chunkSize))
+}
+
+// cutPoint returns the length of the first chunk of b, b holds at least max
+// bytes unless it is the end of the file.
+func cutPoint(b []byte, max int) int {
+	if len(b) > max {
+		b = b[:max]
+	}
+	min := max / 8
+	if len(b) <= min {
+		return len(b)
+	}
+	mask := ^uint64(0) << (65 - bits.Len(uint(max/4)))
+	var h uint64
+	for i := min; i < len(b); i++ {
+		h = h<<1 + gearTable[b[i]]
+		if h&mask == 0 {
+			return i + 1
+		}
+	}
+	return len(b)
+}
+
+// newChunkHash returns the keyed hash that finds chunks written with keys.
+func newChunkHash(keys volumeKeys) hash.Hash {
+	mac := hmac.New(sha256.New, keys.data)
+	mac.Write([]byte("chunk hash"))
+	return hmac.New(sha256.New, mac.Sum(nil))
+}
+
+func chunkHash(keys volumeKeys, chunk []byte) []byte {
+	h := newChunkHash(keys)
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+// setDedup turns dedup of the volume on or off.
+func (fs *ffs) setDedup(value string) error {
+	switch value {
+	case "on":
+		fs.dedup = true
+	case "off":
+		fs.dedup = false
+	default:
+		return fmt.Errorf("unknown dedup %s, use on or off", value)
+	}
+	log.Printf("Dedup %s \n", value)
+	return fs.setSetting("dedup", value)
+}
+
+// queueDedup has the dedup worker cut file rowid in chunks.
+func (fs *ffs) queueDedup(rowid uint64) error {
+	_, err := fs.DB.Exec("INSERT OR IGNORE into dedups(rowid) VALUES (?)", rowid)
+	return err
+}
+
+// dedupEvery runs the dedup worker while the volume is mounted.
+func (fs *ffs) dedupEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := fs.dedupQueued(); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"dedup failed: %s"+nlib.BashFontColor_RESET, err)
+		}
+	}
+}
+
+// dedupQueued cuts the queued files in chunks and returns how many of them
+// were busy, those stay in the queue.
+func (fs *ffs) dedupQueued() (int, error) {
+	rows, err := fs.DB.Query("select rowid from dedups order by rowid")
+	if err != nil {
+		return 0, err
+	}
+	var queued []uint64
+	for rows.Next() {
+		var rowid uint64
+		rows.Scan(&rowid)
+		queued = append(queued, rowid)
+	}
+	rows.Close()
+	busy := 0
+	for _, rowid := range queued {
+		err := fs.dedupFile(rowid)
+		if err == errFileBusy {
+			busy++
+			continue
+		}
+		if err != nil {
+			log.Printf(nlib.BashFontColor_RED+"dedup of %s failed, it stays in stripes: %s"+nlib.BashFontColor_RESET, fs.fileName(rowid), err)
+		}
+		if _, err := fs.DB.Exec("delete from dedups where rowid=?", rowid); err != nil {
+			return busy, err
+		}
+	}
+	return busy, nil
+}
+
+// dedupFile stores file rowid of the stripe format as content defined chunks
+// and removes its shards. The stripes are read and the chunks stored one at a
+// time without holding fs.lock, a file that is opened or changed meanwhile is
+// busy and stays as it was.
+func (fs *ffs) dedupFile(rowid uint64) error {
+	fs.lock.Lock()
+	var deduped, packed, inline bool
+	fs.DB.QueryRow("select deduped,packed,inline is not null from items where rowid=?", rowid).Scan(&deduped, &packed, &inline)
+	f, err := fs.findFile(rowid)
+	if err != nil || deduped || packed || inline || f.chunkSize == 0 || f.fsize <= fs.packThreshold {
+		fs.lock.Unlock()
+		return nil
+	}
+	if fs.isOpen(rowid) {
+		fs.lock.Unlock()
+		return errFileBusy
+	}
+	fs.deduping, fs.dedupTouched = rowid, false
+	fs.lock.Unlock()
+
+	var refs []manifestChunk
+	err = fs.cutFile(f, func(ofst int64, chunk []byte, keys volumeKeys, compress byte) error {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		if fs.dedupTouched {
+			return errFileBusy
+		}
+		object, err := fs.refChunk(chunk, keys, compress)
+		if err == nil {
+			refs = append(refs, manifestChunk{ofst: ofst, object: object, size: int64(len(chunk))})
+		}
+		return err
+	})
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.deduping = 0
+	if err == nil && fs.dedupTouched {
+		err = errFileBusy
+	}
+	if err == nil {
+		err = fs.replaceChunks(rowid, 0, 0, refs, f.fsize)
+	}
+	if err != nil {
+		fs.unrefChunks(refs)
+		return err
+	}
+	fs.removeShards(rowid)
+	return nil
+}
+
+// cutFile reads stored file f stripe by stripe and calls add with every
+// chunk it is cut in.
+func (fs *ffs) cutFile(f storedFile, add func(ofst int64, chunk []byte, keys volumeKeys, compress byte) error) error {
+	fc, err := fs.cryptOf(f)
+	if err != nil {
+		return err
+	}
+	keys := fs.currentKeys()
+	max := fs.maxDedupChunk()
+	stripes := fs.stripeCount(f.fsize, f.chunkSize)
+	var pending []byte
+	var ofst int64
+	for n := int64(0); n < stripes || len(pending) > 0; {
+		if n < stripes && len(pending) < max {
+			buf, err := fs.readStripe(fc, f.fsize, f.chunkSize, n)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, buf...)
+			n++
+			continue
+		}
+		c := cutPoint(pending, max)
+		if err := add(ofst, pending[:c], keys, fc.compress); err != nil {
+			return err
+		}
+		ofst += int64(c)
+		pending = pending[c:]
+	}
+	return nil
+}
+
+// manifestChunk is a chunk at ofst of a manifest file.
+type manifestChunk struct {
+	ofst   int64
+	object uint64
+	size   int64
+}
+
+// manifestChunks returns the chunks of file rowid that hold bytes of lo up
+// to hi.
+func (fs *ffs) manifestChunks(rowid uint64, lo, hi int64) ([]manifestChunk, error) {
+	rows, err := fs.DB.Query("select manifests.ofst,manifests.object,chunks.size from manifests join chunks on chunks.object=manifests.object where manifests.rowid=? and manifests.ofst<? and manifests.ofst+chunks.size>? order by manifests.ofst", rowid, hi, lo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var chunks []manifestChunk
+	for rows.Next() {
+		var c manifestChunk
+		if err := rows.Scan(&c.ofst, &c.object, &c.size); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+// cutChunks cuts data at ofst of a file in chunks and references them.
+func (fs *ffs) cutChunks(data []byte, ofst int64, compress byte) ([]manifestChunk, error) {
+	keys := fs.currentKeys()
+	max := fs.maxDedupChunk()
+	var refs []manifestChunk
+	for len(data) > 0 {
+		c := cutPoint(data, max)
+		object, err := fs.refChunk(data[:c], keys, compress)
+		if err != nil {
+			fs.unrefChunks(refs)
+			return nil, err
+		}
+		refs = append(refs, manifestChunk{ofst: ofst, object: object, size: int64(c)})
+		ofst += int64(c)
+		data = data[c:]
+	}
+	return refs, nil
+}
+
+// replaceChunks replaces the chunks of file rowid from lo up to hi with refs
+// and makes it a manifest file of size bytes in one transaction. The
+// references of refs are taken already, those of the replaced chunks are
+// dropped.
+func (fs *ffs) replaceChunks(rowid uint64, lo, hi int64, refs []manifestChunk, size int64) error {
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("update chunks set refs=refs-(select count(*) from manifests where manifests.rowid=? and manifests.ofst>=? and manifests.ofst<? and manifests.object=chunks.object) where object in (select object from manifests where rowid=? and ofst>=? and ofst<?)", rowid, lo, hi, rowid, lo, hi); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("delete from manifests where rowid=? and ofst>=? and ofst<?", rowid, lo, hi); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, c := range refs {
+		if _, err := tx.Exec("insert into manifests(rowid,ofst,object) VALUES (?,?,?)", rowid, c.ofst, c.object); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("update items set deduped=1,fsize=?,keygen=?,filekey=null where rowid=?", size, fs.currentKeys().gen, rowid); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fs.dropChunks()
+	return nil
+}
+
+// unrefChunks gives back the references of refs that were not recorded.
+func (fs *ffs) unrefChunks(refs []manifestChunk) {
+	for _, c := range refs {
+		fs.DB.Exec("update chunks set refs=refs-1 where object=?", c.object)
+	}
+	fs.dropChunks()
+}
+
+// refChunk references chunk and returns its object, a chunk no file has yet
+// is stored first.
+func (fs *ffs) refChunk(chunk []byte, keys volumeKeys, compress byte) (uint64, error) {
+	hash := chunkHash(keys, chunk)
+	var object uint64
+	if fs.DB.QueryRow("select object from chunks where hash=?", hash).Scan(&object) == nil {
+		_, err := fs.DB.Exec("update chunks set refs=refs+1 where object=?", object)
+		return object, err
+	}
+	return fs.storeChunk(hash, chunk, keys, compress)
+}
+
+// storeChunk writes chunk as a new chunk object with one reference.
+func (fs *ffs) storeChunk(hash []byte, chunk []byte, keys volumeKeys, compress byte) (uint64, error) {
+	name := hex.EncodeToString(hash)
+	res, err := fs.DB.Exec("insert into items(parentid,name,fsize,isFolder,fullpath,cdate,mdate,chunksize,sumenc,keygen) VALUES (?,?,?,?,?,?,?,?,1,?)", chunkParent, name, len(chunk), false, chunkFolder+name, time.Now(), time.Now(), fs.chunkSize, keys.gen)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	object := uint64(id)
+	fc, err := fs.newFileCrypt(object, keys)
+	if err != nil {
+		return 0, err
+	}
+	fc.compress = compress
+	fs.createFileName(object)
+	if err := fs.writeStripe(fc, fs.chunkSize, 0, chunk, -1); err != nil {
+		return 0, err
+	}
+	if _, err := fs.DB.Exec("update items set filekey=?,format=? where rowid=?", fc.wrapped, fc.format, object); err != nil {
+		return 0, err
+	}
+	_, err = fs.DB.Exec("insert into chunks(hash,keygen,object,size,refs) VALUES (?,?,?,?,1)", hash, keys.gen, object, len(chunk))
+	return object, err
+}
+
+// readObject returns the content of a chunk object.
+func (fs *ffs) readObject(object uint64) ([]byte, error) {
+	f, err := fs.findFile(object)
+	if err != nil {
+		return nil, fmt.Errorf("chunk object %d: %s", object, err)
+	}
+	return fs.readStored(f)
+}
+
+// readChunksAt fills buff from an open manifest file at ofst and returns the
+// number of bytes read. The last chunk read is kept in ChunkBuf, the bytes in
+// Edit are read from there.
+func (fs *ffs) readChunksAt(file *ffs_File, buff []byte, ofst int64) (int, error) {
+	done := 0
+	editEnd := file.EditAt + int64(len(file.Edit))
+	for done < len(buff) && ofst < file.Size {
+		want := file.Size - ofst
+		if want > int64(len(buff)-done) {
+			want = int64(len(buff) - done)
+		}
+		if file.Edit != nil && ofst >= file.EditAt && ofst < editEnd {
+			c := copy(buff[done:int64(done)+want], file.Edit[ofst-file.EditAt:])
+			done += c
+			ofst += int64(c)
+			continue
+		}
+		if file.Edit != nil && ofst < file.EditAt && ofst+want > file.EditAt {
+			want = file.EditAt - ofst
+		}
+		if ofst >= file.Stored {
+			return done, fmt.Errorf("no chunk at %d of %s, it is stored up to %d", ofst, fs.fileName(uint64(file.ID)), file.Stored)
+		}
+		if file.Chunk < 0 || ofst < file.Chunk || ofst >= file.Chunk+int64(len(file.ChunkBuf)) {
+			var start int64
+			var object uint64
+			err := fs.DB.QueryRow("select ofst,object from manifests where rowid=? and ofst<=? order by ofst desc limit 1", file.ID, ofst).Scan(&start, &object)
+			if err != nil {
+				return done, fmt.Errorf("no chunk at %d of %s: %s", ofst, fs.fileName(uint64(file.ID)), err)
+			}
+			data, err := fs.readObject(object)
+			if err != nil {
+				return done, err
+			}
+			if ofst >= start+int64(len(data)) {
+				return done, fmt.Errorf("chunk at %d of %s ends at %d", start, fs.fileName(uint64(file.ID)), start+int64(len(data)))
+			}
+			file.Chunk, file.ChunkBuf = start, data
+		}
+		c := copy(buff[done:int64(done)+want], file.ChunkBuf[ofst-file.Chunk:])
+		done += c
+		ofst += int64(c)
+	}
+	return done, nil
+}
+
+// writeChunksAt writes buff at ofst of the open manifest file at path. The chunks the
+// write falls in are read into Edit and written to it, Edit grows over the
+// following chunks as long as the writes go on from its end. A write
+// elsewhere or an Edit of maxEditChunks chunks puts Edit in chunks first, see
+// flushChunks.
+func (fs *ffs) writeChunksAt(file *ffs_File, path string, buff []byte, ofst int64) error {
+	end := ofst + int64(len(buff))
+	if file.Edit != nil && (ofst < file.EditAt || ofst > file.EditAt+int64(len(file.Edit)) || len(file.Edit) >= maxEditChunks*fs.maxDedupChunk()) {
+		if err := fs.flushChunks(file, path); err != nil {
+			return err
+		}
+	}
+	if file.Edit == nil {
+		file.EditAt, file.EditOld = file.Stored, 0
+		if ofst < file.Stored {
+			chunks, err := fs.manifestChunks(uint64(file.ID), ofst, ofst+1)
+			if err != nil {
+				return err
+			}
+			if len(chunks) == 0 {
+				return fmt.Errorf("no chunk at %d of %s", ofst, fs.fileName(uint64(file.ID)))
+			}
+			file.EditAt = chunks[0].ofst
+		}
+		file.Edit = []byte{}
+	}
+	if err := fs.growEdit(file, end); err != nil {
+		return err
+	}
+	if need := end - file.EditAt; need > int64(len(file.Edit)) {
+		file.Edit = append(file.Edit, make([]byte, need-int64(len(file.Edit)))...)
+	}
+	copy(file.Edit[ofst-file.EditAt:], buff)
+	if end > file.Size {
+		file.Size = end
+	}
+	return nil
+}
+
+// growEdit reads the stored chunks up to hi that Edit does not hold yet.
+func (fs *ffs) growEdit(file *ffs_File, hi int64) error {
+	old := file.EditAt + file.EditOld
+	if hi > file.Stored {
+		hi = file.Stored
+	}
+	if old >= hi {
+		return nil
+	}
+	chunks, err := fs.manifestChunks(uint64(file.ID), old, hi)
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if c.ofst != old {
+			return fmt.Errorf("no chunk at %d of %s", old, fs.fileName(uint64(file.ID)))
+		}
+		data, err := fs.readObject(c.object)
+		if err != nil {
+			return err
+		}
+		// bytes written past the old end of Edit win over the stored ones
+		if have := file.EditAt + int64(len(file.Edit)); have > old {
+			data = data[have-old:]
+		}
+		file.Edit = append(file.Edit, data...)
+		old += c.size
+	}
+	file.EditOld = old - file.EditAt
+	return nil
+}
+
+// flushChunks cuts Edit of the open manifest file at path in chunks that
+// replace the chunks it was read from, the other chunks of the file stay as
+// they are.
+func (fs *ffs) flushChunks(file *ffs_File, path string) error {
+	if file.Edit == nil {
+		return nil
+	}
+	rowid := uint64(file.ID)
+	refs, err := fs.cutChunks(file.Edit, file.EditAt, fs.compressionFor(path))
+	if err != nil {
+		return err
+	}
+	stored := file.Stored
+	if end := file.EditAt + int64(len(file.Edit)); end > stored {
+		stored = end
+	}
+	if err := fs.replaceChunks(rowid, file.EditAt, file.EditAt+file.EditOld, refs, stored); err != nil {
+		fs.unrefChunks(refs)
+		return err
+	}
+	file.Stored = stored
+	file.Edit, file.EditAt, file.EditOld = nil, 0, 0
+	file.Chunk, file.ChunkBuf = -1, nil
+	return nil
+}
+
+// resizeChunks makes the open manifest file at path size bytes long. The
+// chunk the new end falls in is cut again, the chunks after it are dropped
+// and the bytes after the old end are chunks of zeros.
+func (fs *ffs) resizeChunks(file *ffs_File, path string, size int64) error {
+	if err := fs.flushChunks(file, path); err != nil {
+		return err
+	}
+	compress := fs.compressionFor(path)
+	rowid := uint64(file.ID)
+	var refs []manifestChunk
+	lo := size
+	if size < file.Stored {
+		chunks, err := fs.manifestChunks(rowid, size, size+1)
+		if err != nil {
+			return err
+		}
+		if len(chunks) > 0 && chunks[0].ofst < size {
+			data, err := fs.readObject(chunks[0].object)
+			if err != nil {
+				return err
+			}
+			lo = chunks[0].ofst
+			if refs, err = fs.cutChunks(data[:size-lo], lo, compress); err != nil {
+				return err
+			}
+		}
+	} else {
+		max := int64(fs.maxDedupChunk())
+		zeros := make([]byte, max)
+		keys := fs.currentKeys()
+		for ofst := file.Stored; ofst < size; ofst += max {
+			c := size - ofst
+			if c > max {
+				c = max
+			}
+			object, err := fs.refChunk(zeros[:c], keys, compress)
+			if err != nil {
+				fs.unrefChunks(refs)
+				return err
+			}
+			refs = append(refs, manifestChunk{ofst: ofst, object: object, size: c})
+		}
+	}
+	if err := fs.replaceChunks(rowid, lo, math.MaxInt64, refs, size); err != nil {
+		fs.unrefChunks(refs)
+		return err
+	}
+	fs.DB.Exec("update items set mdate=? where rowid=?", time.Now(), rowid)
+	file.Size, file.Stored = size, size
+	file.Chunk, file.ChunkBuf = -1, nil
+	return nil
+}
+
+// releaseChunks drops the references of file rowid and removes the chunks
+// nothing references anymore.
+func (fs *ffs) releaseChunks(rowid uint64) {
+	fs.DB.Exec("update chunks set refs=refs-(select count(*) from manifests where manifests.rowid=? and manifests.object=chunks.object) where object in (select object from manifests where rowid=?)", rowid, rowid)
+	fs.DB.Exec("delete from manifests where rowid=?", rowid)
+	fs.dropChunks()
+}
+
+// dropChunks removes the chunk objects without references.
+func (fs *ffs) dropChunks() (int, error) {
+	rows, err := fs.DB.Query("select object from chunks where refs<=0")
+	if err != nil {
+		return 0, err
+	}
+	var objects []uint64
+	for rows.Next() {
+		var object uint64
+		rows.Scan(&object)
+		objects = append(objects, object)
+	}
+	rows.Close()
+	for _, object := range objects {
+		fs.removeObject(object)
+	}
+	return len(objects), nil
+}
+
+// removeObject removes a chunk object or a pack and its shards.
+func (fs *ffs) removeObject(object uint64) {
+	fs.touch(object)
+	fs.DB.Exec("delete from chunks where object=?", object)
+	fs.DB.Exec("delete from items where rowid=? and parentid<?", object, -1)
+	fs.removeShards(object)
+}
+
+// collectChunks counts the references of every chunk again and removes the
+// chunk objects nothing references, an interrupted dedup can leave both
+// behind.
+func (fs *ffs) collectChunks() error {
+	if _, err := fs.DB.Exec("delete from manifests where rowid not in (select rowid from items where deduped=1)"); err != nil {
+		return err
+	}
+	if _, err := fs.DB.Exec("update chunks set refs=(select count(*) from manifests where manifests.object=chunks.object)"); err != nil {
+		return err
+	}
+	rows, err := fs.DB.Query("select rowid from items where parentid=? and rowid not in (select object from chunks)", chunkParent)
+	if err != nil {
+		return err
+	}
+	var orphans []uint64
+	for rows.Next() {
+		var object uint64
+		rows.Scan(&object)
+		orphans = append(orphans, object)
+	}
+	rows.Close()
+	for _, object := range orphans {
+		fs.removeObject(object)
+	}
+	dropped, err := fs.dropChunks()
+	if err != nil {
+		return err
+	}
+	var count, refs, size int64
+	fs.DB.QueryRow("select count(*),ifnull(sum(refs),0),ifnull(sum(size),0) from chunks").Scan(&count, &refs, &size)
+	log.Printf(nlib.BashFontColor_GREEN+"gc removed %d chunks, %d chunks of %d MB are referenced %d times \n"+nlib.BashFontColor_RESET, dropped+len(orphans), count, size>>20, refs)
+	return nil
+}
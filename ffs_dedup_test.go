@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// cuts returns the chunk lengths cutPoint cuts b in.
+func cuts(b []byte, max int) []int {
+	var lens []int
+	for len(b) > 0 {
+		c := cutPoint(b, max)
+		lens = append(lens, c)
+		b = b[c:]
+	}
+	return lens
+}
+
+// TestCutPoint checks the chunk sizes and that the cut points follow the
+// content, so an insert changes only the chunks around it.
+func TestCutPoint(t *testing.T) {
+	const max = 64 << 10
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	lens := cuts(data, max)
+	for i, c := range lens {
+		if c > max || (c < max/8 && i < len(lens)-1) {
+			t.Fatalf("chunk %d is %d bytes", i, c)
+		}
+	}
+	if avg := len(data) / len(lens); avg < max/4 || avg > max/2 {
+		t.Fatalf("chunks are %d bytes on average", avg)
+	}
+	if len(cuts(make([]byte, 3*max), max)) != 3 {
+		t.Fatal("zeros are not cut at the largest size")
+	}
+	if c := cutPoint(data[:max/8], max); c != max/8 {
+		t.Fatal("short end", c)
+	}
+
+	ends := func(lens []int, shift int) map[int]bool {
+		m := map[int]bool{}
+		end := 0
+		for _, c := range lens {
+			end += c
+			m[end-shift] = true
+		}
+		return m
+	}
+	old := ends(lens, 0)
+	edited := append(append(append([]byte{}, data[:1<<20]...), "inserted"...), data[1<<20:]...)
+	moved := 0
+	for end := range ends(cuts(edited, max), len("inserted")) {
+		if end > 1<<20 && !old[end] {
+			moved++
+		}
+	}
+	if moved > 2 {
+		t.Fatalf("%d cut points after the insert moved", moved)
+	}
+}
+
+// dedupAll runs the dedup worker until the queue is empty.
+func dedupAll(t *testing.T, fs *ffs) {
+	if busy, err := fs.dedupQueued(); err != nil || busy > 0 {
+		t.Fatal("dedup", busy, err)
+	}
+}
+
+// manifestOf returns the chunks of the file at path by offset.
+func manifestOf(fs *ffs, path string) map[int64]uint64 {
+	m := map[int64]uint64{}
+	rows, err := fs.DB.Query("select ofst,object from manifests where rowid=(select rowid from items where fullpath=?)", path)
+	if err != nil {
+		return m
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ofst int64
+		var object uint64
+		rows.Scan(&ofst, &object)
+		m[ofst] = object
+	}
+	return m
+}
+
+// TestManifestWrite checks that the worker dedups a released file and that a
+// write or a truncate replaces only the chunks it falls in.
+func TestManifestWrite(t *testing.T) {
+	fs := newTestFS(t, 3)
+	if err := fs.setDedup("on"); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 200000)
+	rand.Read(data)
+	writeFile(t, fs, "/a", data)
+	if len(manifestOf(fs, "/a")) != 0 {
+		t.Fatal("deduped on release")
+	}
+	dedupAll(t, fs)
+	before := manifestOf(fs, "/a")
+	if len(before) < 5 {
+		t.Fatal("chunks", len(before))
+	}
+
+	ofst := int64(len(data) / 2)
+	_, fh := fs.Open("/a", 2)
+	fs.Write("/a", []byte("XYZ"), ofst, fh)
+	fs.Flush("/a", fh)
+	fs.Release("/a", fh)
+	copy(data[ofst:], "XYZ")
+	if !bytes.Equal(readAll(t, fs, "/a"), data) {
+		t.Fatal("write")
+	}
+	after := manifestOf(fs, "/a")
+	changed := 0
+	for o, object := range after {
+		if before[o] != object {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 3 {
+		t.Fatalf("%d of %d chunks changed", changed, len(after))
+	}
+
+	size := int64(len(data)) / 3
+	if fs.Truncate("/a", size, ^uint64(0)) != 0 || fs.Truncate("/a", size+1000, ^uint64(0)) != 0 {
+		t.Fatal("truncate")
+	}
+	data = append(data[:size], make([]byte, 1000)...)
+	if !bytes.Equal(readAll(t, fs, "/a"), data) {
+		t.Fatal("truncate read")
+	}
+	for o, object := range manifestOf(fs, "/a") {
+		if o+int64(fs.maxDedupChunk()) < size && before[o] != object {
+			t.Fatal("truncate changed the chunk at", o)
+		}
+	}
+}
+
+// TestDedupShared checks that two files with the same content share their
+// chunks and that a write to one of them leaves the other as it was.
+func TestDedupShared(t *testing.T) {
+	fs := newTestFS(t, 3)
+	if err := fs.setDedup("on"); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 200000)
+	rand.Read(data)
+	writeFile(t, fs, "/a", data)
+	writeFile(t, fs, "/b", data)
+	dedupAll(t, fs)
+	a, b := manifestOf(fs, "/a"), manifestOf(fs, "/b")
+	if len(a) < 2 || len(a) != len(b) {
+		t.Fatal("chunks", len(a), len(b))
+	}
+	for o, object := range a {
+		if b[o] != object {
+			t.Fatal("chunk not shared at", o)
+		}
+	}
+
+	_, fh := fs.Open("/a", 2)
+	fs.Write("/a", []byte("XYZ"), 100, fh)
+	fs.Flush("/a", fh)
+	fs.Release("/a", fh)
+	dedupAll(t, fs)
+	edited := append([]byte{}, data...)
+	copy(edited[100:], "XYZ")
+	if !bytes.Equal(readAll(t, fs, "/a"), edited) || !bytes.Equal(readAll(t, fs, "/b"), data) {
+		t.Fatal("write to a shared file")
+	}
+}
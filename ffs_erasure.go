@@ -0,0 +1,179 @@
+package main
+
+import "errors"
+
+// Reed-Solomon erasure coding over GF(2^8).
+//
+// The parity rows are a Cauchy matrix whose columns are scaled so the first
+// row is all ones. Every square sub matrix of it stays invertible, so any k
+// of the k+m shards are enough to get the data back, and the first parity
+// shard is the plain XOR of the data shards. That keeps volumes written with
+// the single XOR .sum readable as k+1 volumes.
+
+var errTooManyMissing = errors.New("more parts are missing than there are parity shards, data can not be recovered")
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd does dst ^= c*src for every byte.
+func gfMulAdd(dst []byte, c byte, src []byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i, b := range src {
+			dst[i] ^= b
+		}
+		return
+	}
+	var table [256]byte
+	for i := range table {
+		table[i] = gfMul(c, byte(i))
+	}
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// gfInvert inverts the square matrix m in place of a copy.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	a := make([][]byte, n)
+	inv := make([][]byte, n)
+	for i := range m {
+		a[i] = append([]byte(nil), m[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && a[p][c] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errors.New("singular matrix")
+		}
+		a[c], a[p] = a[p], a[c]
+		inv[c], inv[p] = inv[p], inv[c]
+		f := gfInv(a[c][c])
+		for j := 0; j < n; j++ {
+			a[c][j] = gfMul(a[c][j], f)
+			inv[c][j] = gfMul(inv[c][j], f)
+		}
+		for r := 0; r < n; r++ {
+			if r == c || a[r][c] == 0 {
+				continue
+			}
+			f := a[r][c]
+			for j := 0; j < n; j++ {
+				a[r][j] ^= gfMul(f, a[c][j])
+				inv[r][j] ^= gfMul(f, inv[c][j])
+			}
+		}
+	}
+	return inv, nil
+}
+
+// erasure encodes k data shards into m parity shards.
+type erasure struct {
+	k      int
+	m      int
+	parity [][]byte // m rows of k coefficients
+}
+
+func newErasure(k int, m int) *erasure {
+	e := &erasure{k: k, m: m, parity: make([][]byte, m)}
+	for j := 0; j < m; j++ {
+		e.parity[j] = make([]byte, k)
+		for i := 0; i < k; i++ {
+			// 1/(x_j + y_i) with x_j = j, y_i = m+i, scaled by (x_0 + y_i) so row 0 is all ones
+			e.parity[j][i] = gfMul(gfInv(byte(j)^byte(m+i)), byte(m+i))
+		}
+	}
+	return e
+}
+
+// encode returns the m parity shards of the equally sized data shards.
+func (e *erasure) encode(data [][]byte) [][]byte {
+	parity := make([][]byte, e.m)
+	for j := range parity {
+		parity[j] = make([]byte, len(data[0]))
+		for i, shard := range data {
+			gfMulAdd(parity[j], e.parity[j][i], shard)
+		}
+	}
+	return parity
+}
+
+// reconstruct fills the nil data shards of shards (k data shards followed by
+// m parity shards) from any k shards that are present.
+func (e *erasure) reconstruct(shards [][]byte) error {
+	var rows [][]byte
+	var avail [][]byte
+	missing := false
+	for i, shard := range shards {
+		if i < e.k && shard == nil {
+			missing = true
+		}
+		if shard == nil || len(rows) == e.k {
+			continue
+		}
+		row := make([]byte, e.k)
+		if i < e.k {
+			row[i] = 1
+		} else {
+			copy(row, e.parity[i-e.k])
+		}
+		rows = append(rows, row)
+		avail = append(avail, shard)
+	}
+	if !missing {
+		return nil
+	}
+	if len(rows) < e.k {
+		return errTooManyMissing
+	}
+	inv, err := gfInvert(rows)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < e.k; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shard := make([]byte, len(avail[0]))
+		for t, src := range avail {
+			gfMulAdd(shard, inv[i][t], src)
+		}
+		shards[i] = shard
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestErasure encodes k data shards and gets them back from every pattern of
+// up to m missing shards.
+func TestErasure(t *testing.T) {
+	for _, c := range []struct{ k, m int }{{1, 1}, {2, 1}, {3, 1}, {2, 2}, {3, 2}, {4, 3}, {5, 2}, {6, 4}} {
+		e := newErasure(c.k, c.m)
+		data := make([][]byte, c.k)
+		for i := range data {
+			data[i] = make([]byte, 257)
+			rand.Read(data[i])
+		}
+		parity := e.encode(data)
+		xor := make([]byte, len(data[0]))
+		for _, shard := range data {
+			for i, b := range shard {
+				xor[i] ^= b
+			}
+		}
+		if !bytes.Equal(parity[0], xor) {
+			t.Fatalf("k=%d m=%d: the first parity shard is not the XOR of the data", c.k, c.m)
+		}
+		n := c.k + c.m
+		for missing := 0; missing < 1<<n; missing++ {
+			shards := make([][]byte, n)
+			lost := 0
+			for i := range shards {
+				if missing&(1<<i) != 0 {
+					lost++
+					continue
+				}
+				if i < c.k {
+					shards[i] = append([]byte{}, data[i]...)
+				} else {
+					shards[i] = parity[i-c.k]
+				}
+			}
+			err := e.reconstruct(shards)
+			if lost > c.m {
+				if err != errTooManyMissing && missing&(1<<c.k-1) != 0 {
+					t.Fatalf("k=%d m=%d missing %b: %v, want errTooManyMissing", c.k, c.m, missing, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("k=%d m=%d missing %b: %s", c.k, c.m, missing, err)
+			}
+			for i := 0; i < c.k; i++ {
+				if !bytes.Equal(shards[i], data[i]) {
+					t.Fatalf("k=%d m=%d missing %b: data shard %d differs", c.k, c.m, missing, i)
+				}
+			}
+		}
+	}
+}
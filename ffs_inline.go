@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Inline files
+//
+// Flush keeps a file of up to inlineThreshold bytes (--inline-threshold) in
+// items.inline instead of shards, so it costs no objects on the providers
+// and is read from the replicated database alone. The content is sealed
+// like a chunk with the file key, as shard inlineShard of stripe 0, and the
+// algorithm byte comes first:
+//
+//	0  1  compression, see ffs_compress.go
+//	1     nonce and sealed content
+//
+// An open inline file keeps its content as stripe 0 in Buf. When it grows
+// past the threshold it is flushed to shards and items.inline is cleared. A
+// rekey seals the inline files again with a new file key, they are not
+// walked by scrub and rebuild, the database replicas keep them.
+
+const inlineShard = 0xffff // shard index in the associated data of inline content
+
+// setInlineThreshold sets the size up to which files are kept inline, 0
+// turns it off. Inline files fit in the first stripe.
+func (fs *ffs) setInlineThreshold(size int) error {
+	if size < 0 {
+		return fmt.Errorf("inline threshold can not be negative")
+	}
+	if w := fs.stripeWidth(fs.chunkSize); int64(size) > w {
+		return fmt.Errorf("inline threshold can be up to a stripe, %d bytes", w)
+	}
+	fs.inlineThreshold = int64(size)
+	log.Printf("Inline threshold %d bytes \n", size)
+	return fs.setSetting("inline_threshold", strconv.Itoa(size))
+}
+
+// inlines tells if an open file is kept inline when it is flushed.
+func (fs *ffs) inlines(file *ffs_File) bool {
+	return fs.inlineThreshold > 0 && file.Size <= fs.inlineThreshold && file.ChunkSize > 0 && file.Crypt != nil && file.Crypt.aead != nil
+}
+
+// sealInline seals the content of a file for items.inline.
+func sealInline(fc *fileCrypt, data []byte) []byte {
+	algo, sealed := fc.seal(inlineShard, 0, data)
+	return append([]byte{algo}, sealed...)
+}
+
+// openInline opens items.inline of a file.
+func openInline(fc *fileCrypt, inline []byte) ([]byte, error) {
+	if len(inline) < 1 || fc.aead == nil {
+		return nil, errChunkAuth
+	}
+	data, err := fc.open(inlineShard, 0, inline[0], inline[1:])
+	if err != nil {
+		return nil, fmt.Errorf("inline content of file %d: %w", fc.rowid, err)
+	}
+	return data, nil
+}
+
+// inlineFile stores an open file in items.inline and removes its shards.
+func (fs *ffs) inlineFile(file *ffs_File) error {
+	if file.Stripe != 0 {
+		if err := fs.loadStripe(file, 0); err != nil {
+			return err
+		}
+	}
+	rowid := uint64(file.ID)
+	data := padTo(file.Buf, int(file.Size))[:file.Size]
+	if _, err := fs.DB.Exec("update items set inline=?,fsize=?,mdate=? where rowid=?", sealInline(file.Crypt, data), file.Size, time.Now(), rowid); err != nil {
+		return err
+	}
+	if file.Stored > 0 {
+		fs.removeShards(rowid)
+	}
+	file.Buf = data
+	file.Stored = 0
+	file.Inline = true
+	file.Dirty = false
+	file.Changed = false
+	file.Chunk = -1
+	return nil
+}
+
+// rekeyInline seals the inline files of older key sets again under cur and
+// returns the number of open ones it left for later.
+func (fs *ffs) rekeyInline(cur volumeKeys) (int, error) {
+	defer fs.synchronize()()
+	rows, err := fs.DB.Query("select rowid,fullpath,keygen,filekey,format,inline from items where inline is not null and keygen<>?", cur.gen)
+	if err != nil {
+		return 0, err
+	}
+	type inlineFile struct {
+		rowid           uint64
+		fullpath        string
+		keygen, format  int
+		filekey, inline []byte
+	}
+	var files []inlineFile
+	for rows.Next() {
+		var f inlineFile
+		rows.Scan(&f.rowid, &f.fullpath, &f.keygen, &f.filekey, &f.format, &f.inline)
+		files = append(files, f)
+	}
+	rows.Close()
+	busy := 0
+	for _, f := range files {
+		if fs.isOpen(f.rowid) {
+			busy++
+			continue
+		}
+		old, err := fs.fileCrypt(f.rowid, f.keygen, f.filekey, f.format)
+		if err != nil {
+			return busy, err
+		}
+		data, err := openInline(old, f.inline)
+		if err != nil {
+			return busy, err
+		}
+		fc, err := fs.newFileCrypt(f.rowid, cur)
+		if err != nil {
+			return busy, err
+		}
+		fc.compress = fs.compressionFor(f.fullpath)
+		if _, err := fs.DB.Exec("update items set inline=?,keygen=?,filekey=?,format=? where rowid=?", sealInline(fc, data), cur.gen, fc.wrapped, fc.format, f.rowid); err != nil {
+			return busy, err
+		}
+		log.Printf("rekey inline %s", f.fullpath)
+	}
+	if busy > 0 {
+		log.Printf(nlib.BashFontColor_YELLOW+"rekey %d inline files are in use, they are done later"+nlib.BashFontColor_RESET, busy)
+	}
+	return busy, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Key providers
+//
+// The secret that unlocks a key slot can come from the --password flag, a
+// keyfile, an environment variable, a prompt on the terminal or the standard
+// output of a helper command, so it does not have to be on the command line
+// where everyone on the host sees it in ps. Automation uses the helper
+// command to fetch it from a secret store at boot.
+
+// keyProvider returns the secret of a key slot.
+type keyProvider interface {
+	secret() (string, error)
+	String() string
+}
+
+type passwordKey string // given on the command line
+type keyfileKey string  // content of a file
+type envKey string      // environment variable
+type commandKey string  // standard output of a shell command
+type promptKey struct { // typed on the terminal
+	prompt  string
+	confirm bool // ask twice, for new secrets
+}
+
+func (k passwordKey) secret() (string, error) { return string(k), nil }
+func (k passwordKey) String() string          { return "password" }
+
+func (k keyfileKey) secret() (string, error) {
+	b, err := ioutil.ReadFile(string(k))
+	if err != nil {
+		return "", err
+	}
+	if len(b) == 0 {
+		return "", fmt.Errorf("keyfile %s is empty", string(k))
+	}
+	return string(b), nil
+}
+func (k keyfileKey) String() string { return "keyfile " + string(k) }
+
+// secret reads the variable and removes it, so the processes ffs starts do
+// not inherit it.
+func (k envKey) secret() (string, error) {
+	v, ok := os.LookupEnv(string(k))
+	if !ok || v == "" {
+		return "", fmt.Errorf("environment variable %s is not set", string(k))
+	}
+	os.Unsetenv(string(k))
+	return v, nil
+}
+func (k envKey) String() string { return "environment variable " + string(k) }
+
+// secret runs the command with /bin/sh, one trailing newline of its output
+// is not part of the secret.
+func (k commandKey) secret() (string, error) {
+	cmd := exec.Command("/bin/sh", "-c", string(k))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("key command failed: %s", err)
+	}
+	out = bytes.TrimSuffix(bytes.TrimSuffix(out, []byte("\n")), []byte("\r"))
+	if len(out) == 0 {
+		return "", fmt.Errorf("key command printed nothing")
+	}
+	return string(out), nil
+}
+func (k commandKey) String() string { return "key command" }
+
+func (k promptKey) secret() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("standard input is not a terminal, a password can not be asked")
+	}
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	s, err := read(k.prompt + ": ")
+	if err != nil {
+		return "", err
+	}
+	if s == "" {
+		return "", fmt.Errorf("empty password")
+	}
+	if k.confirm {
+		again, err := read("Repeat " + strings.ToLower(k.prompt) + ": ")
+		if err != nil {
+			return "", err
+		}
+		if again != s {
+			return "", fmt.Errorf("passwords do not match")
+		}
+	}
+	return s, nil
+}
+func (k promptKey) String() string { return "terminal prompt" }
+
+// newKeyProvider picks the provider of the flags that are given, at most one
+// of them may be. Without any the password is asked on the terminal.
+func newKeyProvider(password, keyfile, env, command string, prompt promptKey) (keyProvider, error) {
+	var providers []keyProvider
+	if password != "" {
+		providers = append(providers, passwordKey(password))
+	}
+	if keyfile != "" {
+		providers = append(providers, keyfileKey(keyfile))
+	}
+	if env != "" {
+		providers = append(providers, envKey(env))
+	}
+	if command != "" {
+		providers = append(providers, commandKey(command))
+	}
+	switch len(providers) {
+	case 0:
+		return prompt, nil
+	case 1:
+		return providers[0], nil
+	}
+	return nil, fmt.Errorf("%s and %s are both given, a secret can come from only one of them", providers[0], providers[1])
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Volume keys
+//
+// Parts, parity and metadata replicas are encrypted with a key set of three
+// keys. They are random for new volumes. Volumes created before keys were
+// wrapped keep the keys that were derived from the MD5 of the password, so
+// their data stays readable.
+//
+// The key sets are kept in a key ring sealed with AES-256-GCM under the
+// random master key of the volume. The master key is sealed in the key slots
+// of the superblock, each under a key that Argon2id derives from its own
+// password or keyfile and a random salt, see ffs_keyslots.go. A wrong
+// password fails the GCM check of every slot. Changing the password only
+// wraps the master key again. A rekey puts a new key set in front of the ring
+// under a new master key, every file records the generation of the key set it
+// is written with in items.keygen, and the older sets are dropped when no
+// file uses them anymore.
+//
+// The slots, the ring and the generation of the header are authenticated with
+// an HMAC under a key derived from the master key. A header whose MAC does not
+// match is skipped and the next older one is tried, and the database records
+// the generation of the header, so a header that is older than the one the
+// database knows is refused instead of bringing back a revoked slot.
+
+const (
+	kdfArgon2id   = "argon2id"
+	argonTime     = 3
+	argonMemory   = 64 * 1024 // KiB
+	argonThreads  = 4
+	volumeKeySize = 32
+)
+
+var (
+	errWrongPassword = errors.New("the password does not unlock the volume")
+	errKeyHeaderMAC  = errors.New("key header does not authenticate")
+)
+
+// volumeKeys are the keys the data is encrypted with, gen is the generation
+// of the set.
+type volumeKeys struct {
+	gen  int
+	data []byte
+	sum  []byte
+	meta []byte
+}
+
+// keyRing holds the key sets of the volume, the newest first. It has more
+// than one set only while a rekey runs.
+type keyRing []volumeKeys
+
+// keyHeader is the part of the superblock that holds the key slots and the
+// key ring. Generation goes up every time it changes, so stale copies can be
+// found.
+type keyHeader struct {
+	Slots      []keySlot `json:"slots,omitempty"`
+	Ring       []byte    `json:"ring,omitempty"` // nonce followed by the key ring sealed with the master key
+	Generation int       `json:"generation"`
+	MAC        []byte    `json:"mac,omitempty"` // HMAC-SHA256 of the rest of the header, see mac
+
+	// the single password slot of format 3 headers
+	KDF        string `json:"kdf,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Time       uint32 `json:"time,omitempty"`
+	Memory     uint32 `json:"memory,omitempty"`
+	Threads    uint8  `json:"threads,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+}
+
+// legacyKeys are the keys older versions derived from the password.
+func legacyKeys(password string) volumeKeys {
+	return volumeKeys{
+		data: []byte(nlib.GetMD5Hash(password)),
+		sum:  []byte(nlib.GetMD5Hash(password + ".sum")),
+		meta: []byte(nlib.GetMD5Hash(password + ".meta")),
+	}
+}
+
+// readRandom fills b from crypto/rand. A key, salt or nonce that may be
+// zeros is never used, ffs stops instead.
+func readRandom(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("random source failed: %s", err))
+	}
+}
+
+// randomKey returns a new random key.
+func randomKey() []byte {
+	key := make([]byte, volumeKeySize)
+	readRandom(key)
+	return key
+}
+
+// randomKeys returns new keys of generation gen derived from a random key.
+func randomKeys(gen int) volumeKeys {
+	seed := randomKey()
+	sub := func(label string) []byte {
+		mac := hmac.New(sha256.New, seed)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	return volumeKeys{gen: gen, data: sub("data"), sum: sub("sum"), meta: sub("meta")}
+}
+
+type ringEntry struct {
+	Gen  int      `json:"gen"`
+	Keys [][]byte `json:"keys"` // data, parity and metadata key
+}
+
+func (ring keyRing) marshal() []byte {
+	entries := make([]ringEntry, len(ring))
+	for i, keys := range ring {
+		entries[i] = ringEntry{Gen: keys.gen, Keys: [][]byte{keys.data, keys.sum, keys.meta}}
+	}
+	b, _ := json.Marshal(entries)
+	return b
+}
+
+func unmarshalRing(b []byte) (keyRing, error) {
+	var entries []ringEntry
+	if err := json.Unmarshal(b, &entries); err != nil || len(entries) == 0 {
+		return nil, fmt.Errorf("key ring is broken")
+	}
+	ring := make(keyRing, len(entries))
+	for i, e := range entries {
+		if len(e.Keys) != 3 {
+			return nil, fmt.Errorf("key ring is broken")
+		}
+		ring[i] = volumeKeys{gen: e.Gen, data: e.Keys[0], sum: e.Keys[1], meta: e.Keys[2]}
+	}
+	return ring, nil
+}
+
+// unmarshalKeys reads the keys a header without a ring wrapped directly.
+func unmarshalKeys(b []byte) (volumeKeys, error) {
+	var k [][]byte
+	if err := json.Unmarshal(b, &k); err != nil || len(k) != 3 {
+		return volumeKeys{}, fmt.Errorf("volume keys are broken")
+	}
+	return volumeKeys{data: k[0], sum: k[1], meta: k[2]}, nil
+}
+
+// get returns the key set of generation gen.
+func (ring keyRing) get(gen int) (volumeKeys, error) {
+	for _, keys := range ring {
+		if keys.gen == gen {
+			return keys, nil
+		}
+	}
+	return volumeKeys{}, fmt.Errorf("no key of generation %d in the key ring", gen)
+}
+
+func sealKey(kek []byte, plain []byte) []byte {
+	block, _ := aes.NewCipher(kek)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	readRandom(nonce)
+	return gcm.Seal(nonce, nonce, plain, nil)
+}
+
+func openKey(kek []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errWrongPassword
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errWrongPassword
+	}
+	return plain, nil
+}
+
+// newKeyHeader returns a header with one slot wrapping master under secret
+// and ring sealed with master.
+func newKeyHeader(slot keySlot, master []byte, ring keyRing, generation int) *keyHeader {
+	kh := &keyHeader{Slots: []keySlot{slot}, Generation: generation}
+	kh.Ring = sealKey(master, ring.marshal())
+	return kh
+}
+
+// mac authenticates everything in the header but the MAC itself under a key
+// derived from master.
+func (kh *keyHeader) mac(master []byte) []byte {
+	c := *kh
+	c.MAC = nil
+	b, _ := json.Marshal(c)
+	key := hmac.New(sha256.New, master)
+	key.Write([]byte("key header"))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// sign sets the MAC of the header.
+func (kh *keyHeader) sign(master []byte) {
+	kh.MAC = kh.mac(master)
+}
+
+// verify tells if the header carries a valid MAC under master.
+func (kh *keyHeader) verify(master []byte) bool {
+	return kh.MAC != nil && master != nil && hmac.Equal(kh.MAC, kh.mac(master))
+}
+
+// slots returns the key slots of the header, a format 3 header has one.
+func (kh *keyHeader) slots() []keySlot {
+	if len(kh.Slots) == 0 && kh.WrappedKey != nil {
+		return []keySlot{{KDF: kh.KDF, Salt: kh.Salt, Time: kh.Time, Memory: kh.Memory, Threads: kh.Threads, WrappedKey: kh.WrappedKey}}
+	}
+	return kh.Slots
+}
+
+// unlock returns the master key, the key ring and the slot secret opens. A
+// header written before there was a ring wraps the keys directly, they come
+// back as a ring of one set and no master key.
+func (kh *keyHeader) unlock(secret string) ([]byte, keyRing, keySlot, error) {
+	for _, slot := range kh.slots() {
+		plain, err := slot.open(secret)
+		if err == errWrongPassword {
+			continue
+		}
+		if err != nil {
+			return nil, nil, slot, err
+		}
+		if kh.Ring == nil {
+			keys, err := unmarshalKeys(plain)
+			return nil, keyRing{keys}, slot, err
+		}
+		b, err := openKey(plain, kh.Ring)
+		if err != nil {
+			return nil, nil, slot, fmt.Errorf("key ring does not open: %s", err)
+		}
+		ring, err := unmarshalRing(b)
+		return plain, ring, slot, err
+	}
+	return nil, nil, keySlot{}, errWrongPassword
+}
+
+// readKeyHeaders returns the key headers of the superblocks, the newest
+// generation first.
+func (fs *ffs) readKeyHeaders() []*keyHeader {
+	var headers []*keyHeader
+	for _, folder := range fs.providers() {
+		b, err := ioutil.ReadFile(filepath.Join(folder, superblockFile))
+		if err != nil {
+			continue
+		}
+		var sb superblock
+		if json.Unmarshal(b, &sb) != nil || sb.Keys == nil {
+			continue
+		}
+		headers = append(headers, sb.Keys)
+	}
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].Generation > headers[j].Generation
+	})
+	return headers
+}
+
+// readKeyHeader returns the newest key header in the superblocks, nil when
+// none of them has one.
+func (fs *ffs) readKeyHeader() *keyHeader {
+	if headers := fs.readKeyHeaders(); len(headers) > 0 {
+		return headers[0]
+	}
+	return nil
+}
+
+// existingVolume tells if the folders already hold a volume.
+func (fs *ffs) existingVolume() bool {
+	if fs.findVolumeID() != "" {
+		return true
+	}
+	if _, err := os.Stat(filepath.Join(fs.folders[0], legacyDbFile)); err == nil {
+		return true
+	}
+	for _, folder := range fs.providers() {
+		if _, err := os.Stat(filepath.Join(folder, metaReplicaFile)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// unlockVolume sets the keys of the volume from the secret of one of its
+// slots. A volume without a key header gets one: new volumes get random keys,
+// older volumes keep the keys derived from the password. setupVolume checks
+// those with checkLegacyKeys and writes the header to the superblocks.
+func (fs *ffs) unlockVolume(password string) error {
+	if headers := fs.readKeyHeaders(); len(headers) > 0 {
+		var kh *keyHeader
+		var master []byte
+		var ring keyRing
+		var slot keySlot
+		err := errWrongPassword
+		for _, h := range headers {
+			master, ring, slot, err = h.unlock(password)
+			if err == errWrongPassword {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if master != nil && h.MAC != nil && !h.verify(master) {
+				log.Printf(nlib.BashFontColor_RED+"key header generation %d is skipped: %s"+nlib.BashFontColor_RESET, h.Generation, errKeyHeaderMAC)
+				err = errKeyHeaderMAC
+				continue
+			}
+			kh = h
+			break
+		}
+		if kh == nil {
+			return err
+		}
+		fs.master, fs.ring, fs.keys, fs.slot = master, ring, kh, slot.ID
+		if master == nil {
+			fs.master = randomKey()
+			fs.keys = newKeyHeader(newKeySlot(0, slot.Name, password, fs.master), fs.master, ring, kh.Generation+1)
+			fs.keysChanged = true
+		} else if len(kh.Slots) == 0 {
+			fs.keys = &keyHeader{Slots: []keySlot{newKeySlot(0, "", password, master)}, Ring: kh.Ring, Generation: kh.Generation + 1}
+			fs.keysChanged = true
+		}
+		return nil
+	}
+	keys := randomKeys(0)
+	if fs.existingVolume() {
+		keys = legacyKeys(password)
+		fs.legacyUnlock = true
+	}
+	fs.master = randomKey()
+	fs.ring = keyRing{keys}
+	fs.keys = newKeyHeader(newKeySlot(0, "", password, fs.master), fs.master, fs.ring, 1)
+	fs.keysChanged = true
+	return nil
+}
+
+// checkLegacyKeys confirms the keys derived from the password of a volume
+// without a key header before the header binds the volume to them for good: a
+// metadata replica has to open with them, or the parity of a stored file has
+// to match what they decrypt. A volume with nothing stored can not be checked.
+func (fs *ffs) checkLegacyKeys() error {
+	replicas := 0
+	for _, folder := range fs.providers() {
+		if _, err := os.Stat(filepath.Join(folder, metaReplicaFile)); err != nil {
+			continue
+		}
+		replicas++
+		if _, _, err := readReplica(folder, fs.ring); err == nil {
+			return nil
+		}
+	}
+	if replicas > 0 {
+		return fmt.Errorf("%w: none of the %d metadata replicas opens", errWrongPassword, replicas)
+	}
+	files, err := fs.listFiles(0)
+	if err != nil {
+		return err
+	}
+	mismatched := 0
+	for _, f := range files {
+		if f.fsize == 0 {
+			continue
+		}
+		match, checked := fs.keysMatch(f)
+		if match {
+			return nil
+		}
+		if checked {
+			mismatched++
+		}
+		if mismatched >= 3 {
+			break
+		}
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("%w: %d stored files do not decrypt to their parity", errWrongPassword, mismatched)
+	}
+	log.Printf(nlib.BashFontColor_YELLOW + "The password can not be checked, the volume has no stored file \n" + nlib.BashFontColor_RESET)
+	return nil
+}
+
+// keysMatch tells if the first stripe of f decrypts to data that matches its
+// first parity shard. checked is false when a shard is missing.
+func (fs *ffs) keysMatch(f storedFile) (match bool, checked bool) {
+	keys, err := fs.ring.get(f.keyGen)
+	if err != nil {
+		return false, false
+	}
+	if f.fileKey != nil {
+		_, err := fs.cryptOf(f)
+		return err == nil, true
+	}
+	if f.chunkSize == 0 {
+		var data []byte
+		for i := 0; i < fs.dataShards; i++ {
+			if _, err := os.Stat(fs.partPath(f.rowid, i)); err != nil {
+				return false, false
+			}
+			part, err := fs.readPart(f.rowid, keys, i, f.fsize)
+			if err != nil {
+				return false, true
+			}
+			data = append(data, part[:fs.partLen(f.fsize, i)]...)
+		}
+		if _, err := os.Stat(fs.sumPath(f.rowid, 0)); err != nil {
+			return false, false
+		}
+		csum, err := fs.readSum(f.rowid, keys, 0, f.fsize, fs.sumEncrypted(f.rowid))
+		if err != nil {
+			return false, true
+		}
+		return bytes.Equal(fs.parity(data, fs.partSize(f.fsize))[0], csum), true
+	}
+	fc, err := fs.cryptOf(f)
+	if err != nil {
+		return false, false
+	}
+	cs := f.chunkSize
+	l := fs.stripeLen(f.fsize, cs, 0)
+	cl := chunkLen(l, cs, 0)
+	shards := make([][]byte, fs.dataShards+1)
+	for s := range shards {
+		if _, err := os.Stat(fs.shardPath(f.rowid, s)); err != nil {
+			return false, false
+		}
+		want := cl
+		if s < fs.dataShards {
+			want = chunkLen(l, cs, s)
+		}
+		chunk, err := fs.readChunk(fc, s, cs, 0, want)
+		if err != nil {
+			return false, true
+		}
+		shards[s] = padTo(chunk, cl)
+	}
+	return bytes.Equal(fs.erasure.encode(shards[:fs.dataShards])[0], shards[fs.dataShards]), true
+}
+
+// checkKeyGeneration refuses a key header older than the one the database
+// recorded, and a header without a MAC once the database knows signed ones.
+func (fs *ffs) checkKeyGeneration() error {
+	known := fs.getSetting("key_generation", "")
+	if known == "" {
+		return nil
+	}
+	if gen, _ := strconv.Atoi(known); fs.keys.Generation < gen {
+		return fmt.Errorf("%w: generation %d is older than generation %d the database knows", errKeyHeaderMAC, fs.keys.Generation, gen)
+	}
+	if fs.keys.MAC == nil && !fs.keysChanged {
+		return fmt.Errorf("%w: it has no MAC", errKeyHeaderMAC)
+	}
+	return nil
+}
+
+// currentKeys is the key set new data is written with.
+func (fs *ffs) currentKeys() volumeKeys {
+	return fs.ring[0]
+}
+
+// fileKeys returns the key set file rowid is written with.
+func (fs *ffs) fileKeys(rowid uint64) (volumeKeys, error) {
+	var gen int
+	fs.DB.QueryRow("select keygen from items where rowid=?", rowid).Scan(&gen)
+	return fs.ring.get(gen)
+}
+
+// writeSuperblocks writes the superblock to every folder that is there,
+// missing ones get it from checkSuperblocks when they come back.
+func (fs *ffs) writeSuperblocks(all bool) error {
+	for i, folder := range fs.providers() {
+		if _, err := os.Stat(folder); err != nil && !all {
+			log.Printf(nlib.BashFontColor_RED+"%s is not available, its superblock is updated later: %s"+nlib.BashFontColor_RESET, folder, err)
+			continue
+		}
+		if err := fs.writeSuperblock(i); err != nil {
+			return err
+		}
+	}
+	if fs.DB != nil && fs.keys != nil {
+		fs.setSetting("key_generation", strconv.Itoa(fs.keys.Generation))
+	}
+	return nil
+}
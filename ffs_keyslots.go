@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/nuveusltd/nlib"
+	"golang.org/x/crypto/argon2"
+)
+
+// Key slots
+//
+// Like LUKS every member of a team gets a key slot of their own. A slot
+// wraps the same master key under a key that Argon2id derives from the
+// password or keyfile of the slot, so a slot can be added or revoked without
+// touching the others or the data. Every slot is tried when a volume is
+// unlocked. Revoking a slot keeps its owner from unlocking the volume with
+// it, a rekey also replaces the master key they may have kept and keeps only
+// the slot it is run with.
+
+const maxKeySlots = 8
+
+// keySlot wraps the master key under one secret.
+type keySlot struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Created    string `json:"created,omitempty"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"` // KiB
+	Threads    uint8  `json:"threads"`
+	WrappedKey []byte `json:"wrapped_key"` // nonce followed by the sealed master key
+}
+
+// newKeySlot wraps master under secret with a new salt.
+func newKeySlot(id int, name string, secret string, master []byte) keySlot {
+	slot := keySlot{ID: id, Name: name, Created: time.Now().UTC().Format(time.RFC3339), KDF: kdfArgon2id, Salt: make([]byte, 16), Time: argonTime, Memory: argonMemory, Threads: argonThreads}
+	readRandom(slot.Salt)
+	slot.WrappedKey = sealKey(slot.kek(secret), master)
+	return slot
+}
+
+// kek derives the key that wraps the master key from secret.
+func (slot *keySlot) kek(secret string) []byte {
+	return argon2.IDKey([]byte(secret), slot.Salt, slot.Time, slot.Memory, slot.Threads, volumeKeySize)
+}
+
+// open returns the key the slot wraps.
+func (slot *keySlot) open(secret string) ([]byte, error) {
+	if slot.KDF != kdfArgon2id {
+		return nil, fmt.Errorf("slot %d has unknown key derivation %s", slot.ID, slot.KDF)
+	}
+	return openKey(slot.kek(secret), slot.WrappedKey)
+}
+
+// updateKeys makes kh the key header with a new generation and writes it.
+func (fs *ffs) updateKeys(slots []keySlot) error {
+	kh := *fs.keys
+	kh.Slots = slots
+	kh.Generation++
+	fs.keys = &kh
+	return fs.writeSuperblocks(false)
+}
+
+// changePassword wraps the master key under secret in the slot the volume is
+// unlocked with. The data and the other slots stay as they are.
+func (fs *ffs) changePassword(secret string) error {
+	slots := append([]keySlot{}, fs.keys.Slots...)
+	for i, slot := range slots {
+		if slot.ID == fs.slot {
+			slots[i] = newKeySlot(slot.ID, slot.Name, secret, fs.master)
+		}
+	}
+	if err := fs.updateKeys(slots); err != nil {
+		return err
+	}
+	log.Printf(nlib.BashFontColor_GREEN+"Password of slot %d changed, key header generation %d \n"+nlib.BashFontColor_RESET, fs.slot, fs.keys.Generation)
+	return nil
+}
+
+// addKeySlot adds a slot that unlocks the volume with secret.
+func (fs *ffs) addKeySlot(name string, secret string) error {
+	if len(fs.keys.Slots) >= maxKeySlots {
+		return fmt.Errorf("volume has %d key slots, revoke one first", len(fs.keys.Slots))
+	}
+	if _, _, _, err := fs.keys.unlock(secret); err == nil {
+		return fmt.Errorf("this password already unlocks the volume")
+	}
+	id := 0
+	for _, slot := range fs.keys.Slots {
+		if slot.ID >= id {
+			id = slot.ID + 1
+		}
+	}
+	slots := append(append([]keySlot{}, fs.keys.Slots...), newKeySlot(id, name, secret, fs.master))
+	if err := fs.updateKeys(slots); err != nil {
+		return err
+	}
+	log.Printf(nlib.BashFontColor_GREEN+"Key slot %d added \n"+nlib.BashFontColor_RESET, id)
+	return nil
+}
+
+// revokeKeySlot removes slot id, the last slot can not be removed.
+func (fs *ffs) revokeKeySlot(id int) error {
+	var slots []keySlot
+	for _, slot := range fs.keys.Slots {
+		if slot.ID != id {
+			slots = append(slots, slot)
+		}
+	}
+	if len(slots) == len(fs.keys.Slots) {
+		return fmt.Errorf("volume has no key slot %d", id)
+	}
+	if len(slots) == 0 {
+		return fmt.Errorf("slot %d is the last key slot of the volume", id)
+	}
+	if err := fs.updateKeys(slots); err != nil {
+		return err
+	}
+	log.Printf(nlib.BashFontColor_GREEN+"Key slot %d revoked, run rekey if its owner may have kept the master key \n"+nlib.BashFontColor_RESET, id)
+	return nil
+}
+
+// listKeySlots prints the key slots of the volume, it needs no password.
+func (fs *ffs) listKeySlots(w io.Writer) error {
+	kh := fs.readKeyHeader()
+	if kh == nil {
+		return fmt.Errorf("volume has no key header")
+	}
+	fmt.Fprintf(w, "key header generation %d\n", kh.Generation)
+	for _, slot := range kh.slots() {
+		fmt.Fprintf(w, "slot %d\t%s\t%s\t%s t=%d m=%dKiB p=%d\n", slot.ID, slot.Name, slot.Created, slot.KDF, slot.Time, slot.Memory, slot.Threads)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Metadata replicas
+//
+// The database with the names, sizes and dates lives in the local cache
+// folder, the sources only see encrypted copies of it. Every source and
+// checksum folder keeps one in .ffs_meta: the magic "FFMR", the generation as
+// 8 big endian bytes and a snapshot of the SQLite file sealed with AES-256-GCM
+// under the metadata key of the current key set, the magic and the generation
+// are its additional data. The generation is stored in the settings table too
+// and goes up every time the replicas are written. A replica is valid when it
+// opens, so a truncated, altered or foreign copy is never used. Replicas of
+// format 11 and older start with "FFSM" and hold nlib.Encrypt of the
+// generation followed by the database, they are still read.
+//
+// The snapshot is taken with VACUUM INTO, it is consistent even while a FUSE
+// call writes to the database.
+
+const (
+	metaReplicaFile = ".ffs_meta"
+	metaMagic       = "FFMR"
+	legacyMetaMagic = "FFSM"    // nlib.Encrypt replicas of format 11 and older
+	legacyDbFile    = ".mfs_db" // plain database kept in the first source by older versions
+)
+
+// replicaAEAD returns the cipher of the replicas sealed with key.
+func replicaAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealReplica encrypts a database snapshot of generation gen.
+func sealReplica(gen uint64, db []byte, key []byte) ([]byte, error) {
+	aead, err := replicaAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, len(metaMagic)+8)
+	copy(head, metaMagic)
+	binary.BigEndian.PutUint64(head[len(metaMagic):], gen)
+	nonce := make([]byte, aead.NonceSize())
+	readRandom(nonce)
+	return aead.Seal(append(head, nonce...), nonce, db, head), nil
+}
+
+// openReplica opens a replica sealed by sealReplica with key.
+func openReplica(b []byte, key []byte) ([]byte, error) {
+	aead, err := replicaAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	head := len(metaMagic) + 8
+	if len(b) < head+aead.NonceSize() {
+		return nil, fmt.Errorf("replica is truncated")
+	}
+	return aead.Open(nil, b[head:head+aead.NonceSize()], b[head+aead.NonceSize():], b[:head])
+}
+
+// readReplica reads and verifies the replica of a folder, it may be sealed
+// with any key set of the ring.
+func readReplica(folder string, ring keyRing) (uint64, []byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(folder, metaReplicaFile))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < len(metaMagic)+8 {
+		return 0, nil, fmt.Errorf("%s is not a metadata replica", metaReplicaFile)
+	}
+	g := b[len(metaMagic) : len(metaMagic)+8]
+	switch string(b[:len(metaMagic)]) {
+	case metaMagic:
+		for _, keys := range ring {
+			if db, err := openReplica(b, keys.meta); err == nil {
+				return binary.BigEndian.Uint64(g), db, nil
+			}
+		}
+	case legacyMetaMagic:
+		for _, keys := range ring {
+			open := nlib.Decrypt(b[len(metaMagic)+8:], keys.meta)
+			if len(open) >= 8 && bytes.Equal(open[:8], g) {
+				return binary.BigEndian.Uint64(g), open[8:], nil
+			}
+		}
+	default:
+		return 0, nil, fmt.Errorf("%s is not a metadata replica", metaReplicaFile)
+	}
+	return 0, nil, fmt.Errorf("replica does not decrypt")
+}
+
+// newestReplica returns the valid replica with the highest generation.
+func (fs *ffs) newestReplica() (gen uint64, db []byte, from string) {
+	for _, folder := range fs.providers() {
+		g, b, err := readReplica(folder, fs.ring)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf(nlib.BashFontColor_RED+"metadata replica of %s is not usable: %s"+nlib.BashFontColor_RESET, folder, err)
+			}
+			continue
+		}
+		if db == nil || g > gen {
+			gen, db, from = g, b, folder
+		}
+	}
+	return gen, db, from
+}
+
+// dbSetting reads a setting of a database file that is not open, "" when it has none.
+func dbSetting(dbfile string, name string) string {
+	if _, err := os.Stat(dbfile); err != nil {
+		return ""
+	}
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		return ""
+	}
+	defer db.Close()
+	var value string
+	db.QueryRow("select value from settings where name=?", name).Scan(&value)
+	return value
+}
+
+// dbGeneration returns the replica generation recorded in a database file, 0
+// when it has none.
+func dbGeneration(dbfile string) uint64 {
+	gen, _ := strconv.ParseUint(dbSetting(dbfile, "meta_generation"), 10, 64)
+	return gen
+}
+
+// findVolumeID returns the volume id of the first superblock that can be read.
+func (fs *ffs) findVolumeID() string {
+	for _, folder := range fs.providers() {
+		b, err := ioutil.ReadFile(filepath.Join(folder, superblockFile))
+		if err != nil {
+			continue
+		}
+		var sb superblock
+		if json.Unmarshal(b, &sb) == nil && sb.UUID != "" {
+			return sb.UUID
+		}
+	}
+	return ""
+}
+
+// openDb opens the database of the volume in the cache folder. A plain
+// database left in the first source by an older version is moved there and
+// removed from the source after the first replica sync. When the database is
+// missing or older than the newest replica it is restored from that replica.
+// create tells if a new volume may be started when there is neither a
+// database nor a replica.
+func (fs *ffs) openDb(create bool) (created bool, err error) {
+	legacy := filepath.Join(fs.folders[0], legacyDbFile)
+	fs.volumeID = fs.findVolumeID()
+	if fs.volumeID == "" {
+		fs.volumeID = dbSetting(legacy, "uuid")
+	}
+	if fs.volumeID == "" {
+		fs.volumeID = newVolumeID()
+	}
+	if err := os.MkdirAll(fs.cacheDir, 0700); err != nil {
+		return false, err
+	}
+	fs.dbFile = filepath.Join(fs.cacheDir, fs.volumeID+".db")
+	if _, err := os.Stat(legacy); err == nil {
+		if _, err := os.Stat(fs.dbFile); os.IsNotExist(err) {
+			log.Printf(nlib.BashFontColor_YELLOW+"Moving the plain database %s to %s \n"+nlib.BashFontColor_RESET, legacy, fs.dbFile)
+			if err := copyFile(legacy, fs.dbFile); err != nil {
+				return false, err
+			}
+		}
+		fs.legacyDb = legacy
+	}
+
+	gen, replica, from := fs.newestReplica()
+	_, serr := os.Stat(fs.dbFile)
+	if replica != nil && (os.IsNotExist(serr) || dbGeneration(fs.dbFile) < gen) {
+		log.Printf(nlib.BashFontColor_YELLOW+"Restoring metadata generation %d from %s \n"+nlib.BashFontColor_RESET, gen, from)
+		if err := os.MkdirAll(filepath.Dir(fs.dbFile), 0700); err != nil {
+			return false, err
+		}
+		os.Remove(fs.dbFile + "-journal")
+		if err := writeFileAtomic(fs.dbFile, replica); err != nil {
+			return false, err
+		}
+	} else if os.IsNotExist(serr) {
+		if !create {
+			if _, err := os.Stat(fs.folders[0]); err != nil {
+				return false, fmt.Errorf("Database Error 1004: %s not found and no metadata replica, %s is not available and volumes never mounted by this version keep their only database there: %s", fs.dbFile, fs.folders[0], err)
+			}
+			return false, fmt.Errorf("Database Error 1004: %s not found and no metadata replica", fs.dbFile)
+		}
+		fs.CreateDb()
+		return true, nil
+	}
+	fs.DB, err = sql.Open("sqlite3", fs.dbFile)
+	if err != nil {
+		return false, fmt.Errorf("Database Error 1003: %s", err)
+	}
+	return false, nil
+}
+
+// snapshotDb returns a consistent copy of the database.
+func (fs *ffs) snapshotDb() ([]byte, error) {
+	tmp := fs.dbFile + ".snapshot"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if _, err := fs.DB.Exec("VACUUM INTO ?", tmp); err != nil {
+		return nil, fmt.Errorf("snapshot of %s: %w", fs.dbFile, err)
+	}
+	return ioutil.ReadFile(tmp)
+}
+
+// syncMetadata writes a new generation of the replicas when the database
+// changed since the last sync. The first sync of a mount always writes, that
+// also repairs replicas that are stale or missing.
+func (fs *ffs) syncMetadata() error {
+	db, err := fs.snapshotDb()
+	if err != nil {
+		return err
+	}
+	if sha256.Sum256(db) == fs.metaSum {
+		return nil
+	}
+	gen, _ := strconv.ParseUint(fs.getSetting("meta_generation", "0"), 10, 64)
+	gen++
+	if err := fs.setSetting("meta_generation", strconv.FormatUint(gen, 10)); err != nil {
+		return err
+	}
+	if db, err = fs.snapshotDb(); err != nil {
+		return err
+	}
+	sealed, err := sealReplica(gen, db, fs.currentKeys().meta)
+	if err != nil {
+		return err
+	}
+	written := 0
+	for _, folder := range fs.providers() {
+		if err := writeFileAtomic(filepath.Join(folder, metaReplicaFile), sealed); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"metadata replica of %s is not written: %s"+nlib.BashFontColor_RESET, folder, err)
+			continue
+		}
+		written++
+	}
+	if written == 0 {
+		return fmt.Errorf("no metadata replica could be written")
+	}
+	fs.metaSum = sha256.Sum256(db)
+	if fs.legacyDb != "" {
+		os.Remove(fs.legacyDb)
+		os.Remove(fs.legacyDb + "-journal")
+		log.Printf("Plain database %s removed, the sources keep encrypted replicas \n", fs.legacyDb)
+		fs.legacyDb = ""
+	}
+	return nil
+}
+
+// syncMetadataEvery keeps the replicas up to date while the volume is
+// mounted, small files are packed first.
+func (fs *ffs) syncMetadataEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		fs.lock.Lock()
+		if _, err := fs.packFiles(1); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"packing failed: %s"+nlib.BashFontColor_RESET, err)
+		}
+		if err := fs.syncMetadata(); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"metadata sync failed: %s"+nlib.BashFontColor_RESET, err)
+		}
+		fs.lock.Unlock()
+	}
+}
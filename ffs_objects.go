@@ -21,5 +21,31 @@ type ffs_File struct {
 	Mode    uint32
 	Data    []byte
 	DataEnc []byte
-	Kind    int // 0 forWrite 1 forRead
+	Kind    int // 0 forWrite 1 forRead 2 created
+
+	Loaded    bool  // Data holds the content of a file in the whole part format or of a packed file
+	ChunkSize int   // 0 for files in the whole part format
+	Stored    int64 // size of the file on the sources
+	Stripe    int64 // index of the stripe in Buf, -1 for none
+	Buf       []byte
+	Chunk     int64 // index of the chunk in ChunkBuf, -1 for none, its offset for manifest files
+	ChunkBuf  []byte
+	Dirty     bool       // Buf has writes that are not on the sources yet
+	Changed   bool       // fsize and mdate have to be saved on flush
+	Crypt     *fileCrypt // encryption of the file, nil for manifest files
+	Manifest  bool       // the file is stored in dedup chunks, see ffs_dedup.go
+	Packed    bool       // the file is in a pack, see ffs_pack.go
+	Inline    bool       // the file is in items.inline, Buf holds it as stripe 0
+	Written   bool       // written since it was opened, queued for dedup on release
+	Edit      []byte     // written bytes of a manifest file from EditAt, not in chunks yet
+	EditAt    int64      // offset of Edit, the start of a chunk or the stored size
+	EditOld   int64      // bytes of the chunks Edit replaces
+	Handles   int        // open handles of the path, the last release closes it
+}
+
+// openHandle is what a handle of an open file keeps apart from the path.
+type openHandle struct {
+	rowid  uint64
+	write  bool // opened for writing, see Write
+	append bool // opened with O_APPEND, its writes go to the end
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Packs
+//
+// A file of up to packThreshold bytes (--pack-threshold) does not keep shards
+// of its own for long: the pack pass gathers such files into a pack, a
+// hidden file of the stripe format with a file key of its own and the
+// fullpath packFolder+rowid, and removes their shards. The packed table
+// gives the pack, offset and size of every packed file. A pack is written
+// once and never appended to, so a sync client uploads it once. The pass
+// writes one pack with every metadata sync while the volume is mounted and
+// packs everything with the gc command.
+//
+// A packed file that is written again gets shards of its own first, it is
+// packed again by a later pass. When deletes and writes leave less than half
+// of a pack in use, gc compacts it: the files still in it are written to a
+// new pack and the old one is removed. A pack nothing is in anymore is
+// removed right away. Packs are ordinary files to scrub, rebuild and rekey.
+
+const (
+	packParent = -3       // parentid of packs, they are in no folder
+	packFolder = "packs/" // fullpath prefix of packs
+)
+
+// maxPackSize is the number of bytes a pass puts in one pack.
+func (fs *ffs) maxPackSize() int64 {
+	return 16 * fs.stripeWidth(fs.chunkSize)
+}
+
+// setPackThreshold sets the size up to which files are packed, 0 turns
+// packing off.
+func (fs *ffs) setPackThreshold(kb int) error {
+	if kb < 0 {
+		return fmt.Errorf("pack threshold can not be negative")
+	}
+	fs.packThreshold = int64(kb) << 10
+	log.Printf("Pack threshold %d KB \n", kb)
+	return fs.setSetting("pack_threshold", strconv.FormatInt(fs.packThreshold, 10))
+}
+
+// packEntry is a file in a pack.
+type packEntry struct {
+	rowid uint64
+	ofst  int64
+	size  int64
+}
+
+// writePack writes the files of rowids, read gives their content, to a new
+// pack. Files read fails on are left out. The pack, the packed rows and
+// update, when it is not nil, for every file in the pack are committed in
+// one transaction.
+func (fs *ffs) writePack(rowids []uint64, read func(uint64) ([]byte, error), update func(tx *sql.Tx, e packEntry) error) (uint64, []packEntry, error) {
+	keys := fs.currentKeys()
+	res, err := fs.DB.Exec("insert into items(parentid,name,fsize,isFolder,cdate,mdate,chunksize,sumenc,keygen) VALUES (?,?,?,?,?,?,?,1,?)", packParent, "", 0, false, time.Now(), time.Now(), fs.chunkSize, keys.gen)
+	if err != nil {
+		return 0, nil, err
+	}
+	id, _ := res.LastInsertId()
+	pack := uint64(id)
+	name := strconv.FormatUint(pack, 10)
+	fs.DB.Exec("update items set name=?,fullpath=? where rowid=?", name, packFolder+name, pack)
+	fc, err := fs.newFileCrypt(pack, keys)
+	if err != nil {
+		return 0, nil, err
+	}
+	fc.compress = fs.compress
+	w := fs.newStripeWriter(fc, fs.chunkSize)
+	var entries []packEntry
+	for _, rowid := range rowids {
+		data, err := read(rowid)
+		if err != nil {
+			log.Printf(nlib.BashFontColor_RED+"%s is not packed: %s"+nlib.BashFontColor_RESET, fs.fileName(rowid), err)
+			continue
+		}
+		entries = append(entries, packEntry{rowid: rowid, ofst: w.size, size: int64(len(data))})
+		if err := w.write(data); err != nil {
+			fs.removeObject(pack)
+			return 0, nil, err
+		}
+	}
+	if err := w.close(); err != nil {
+		fs.removeObject(pack)
+		return 0, nil, err
+	}
+	if len(entries) == 0 {
+		fs.removeObject(pack)
+		return 0, nil, nil
+	}
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		fs.removeObject(pack)
+		return 0, nil, err
+	}
+	if err := commitPack(tx, pack, w.size, fc, entries, update); err != nil {
+		tx.Rollback()
+		fs.removeObject(pack)
+		return 0, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		fs.removeObject(pack)
+		return 0, nil, err
+	}
+	return pack, entries, nil
+}
+
+// commitPack records pack and the files in it in tx.
+func commitPack(tx *sql.Tx, pack uint64, size int64, fc *fileCrypt, entries []packEntry, update func(tx *sql.Tx, e packEntry) error) error {
+	if _, err := tx.Exec("update items set fsize=?,filekey=?,format=? where rowid=?", size, fc.wrapped, fc.format, pack); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := tx.Exec("INSERT OR REPLACE into packed(rowid,pack,ofst,size) VALUES (?,?,?,?)", e.rowid, pack, e.ofst, e.size); err != nil {
+			return err
+		}
+		if update == nil {
+			continue
+		}
+		if err := update(tx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packFiles moves files of up to packThreshold bytes into at most packs new
+// packs and returns the number of files it packed.
+func (fs *ffs) packFiles(packs int) (int, error) {
+	if fs.packThreshold <= 0 {
+		return 0, nil
+	}
+	packed := 0
+	for ; packs > 0; packs-- {
+		rows, err := fs.DB.Query("select rowid,fsize from items where isFolder=false and deduped=0 and packed=0 and inline is null and parentid>=-1 and fsize>0 and fsize<=? order by rowid", fs.packThreshold)
+		if err != nil {
+			return packed, err
+		}
+		var rowids []uint64
+		var size int64
+		for rows.Next() && size < fs.maxPackSize() {
+			var rowid uint64
+			var fsize int64
+			rows.Scan(&rowid, &fsize)
+			if fs.isOpen(rowid) {
+				continue
+			}
+			rowids = append(rowids, rowid)
+			size += fsize
+		}
+		rows.Close()
+		if len(rowids) == 0 {
+			break
+		}
+		keys := fs.currentKeys()
+		_, entries, err := fs.writePack(rowids, func(rowid uint64) ([]byte, error) {
+			f, err := fs.findFile(rowid)
+			if err != nil {
+				return nil, err
+			}
+			return fs.readStored(f)
+		}, func(tx *sql.Tx, e packEntry) error {
+			_, err := tx.Exec("update items set packed=1,keygen=?,filekey=null where rowid=?", keys.gen, e.rowid)
+			return err
+		})
+		if err != nil {
+			return packed, err
+		}
+		// the shards go only once the files are packed for good
+		for _, e := range entries {
+			fs.touch(e.rowid)
+			fs.removeShards(e.rowid)
+		}
+		packed += len(entries)
+		log.Printf("%d files packed in %d KB \n", len(entries), size>>10)
+		if len(entries) == 0 {
+			break
+		}
+	}
+	return packed, nil
+}
+
+// packEntryOf returns where packed file rowid is.
+func (fs *ffs) packEntryOf(rowid uint64) (uint64, packEntry, error) {
+	e := packEntry{rowid: rowid}
+	var pack uint64
+	err := fs.DB.QueryRow("select pack,ofst,size from packed where rowid=?", rowid).Scan(&pack, &e.ofst, &e.size)
+	if err != nil {
+		return 0, e, fmt.Errorf("%s is not in a pack: %s", fs.fileName(rowid), err)
+	}
+	return pack, e, nil
+}
+
+// readPacked returns the content of packed file rowid, only the stripes of
+// the pack it is in are read.
+func (fs *ffs) readPacked(rowid uint64) ([]byte, error) {
+	pack, e, err := fs.packEntryOf(rowid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.findFile(pack)
+	if err != nil {
+		return nil, fmt.Errorf("pack %d: %s", pack, err)
+	}
+	fc, err := fs.cryptOf(f)
+	if err != nil {
+		return nil, err
+	}
+	if e.ofst+e.size > f.fsize {
+		return nil, fmt.Errorf("%s ends at %d, after the end of pack %d", fs.fileName(rowid), e.ofst+e.size, pack)
+	}
+	w := fs.stripeWidth(f.chunkSize)
+	data := make([]byte, 0, e.size)
+	for n := e.ofst / w; n*w < e.ofst+e.size; n++ {
+		buf, err := fs.readStripe(fc, f.fsize, f.chunkSize, n)
+		if err != nil {
+			return nil, err
+		}
+		start, end := e.ofst-n*w, e.ofst+e.size-n*w
+		if start < 0 {
+			start = 0
+		}
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+		data = append(data, buf[start:end]...)
+	}
+	return data, nil
+}
+
+// unpackFile gives packed file rowid shards of its own with a new file key
+// and takes it out of its pack, so it can be written in place.
+func (fs *ffs) unpackFile(rowid uint64, path string) (*fileCrypt, error) {
+	data, err := fs.readPacked(rowid)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := fs.newFileCrypt(rowid, fs.currentKeys())
+	if err != nil {
+		return nil, err
+	}
+	fc.compress = fs.compressionFor(path)
+	w := fs.newStripeWriter(fc, fs.chunkSize)
+	if err := w.write(data); err != nil {
+		return nil, err
+	}
+	if err := w.close(); err != nil {
+		return nil, err
+	}
+	if _, err := fs.DB.Exec("update items set packed=0,chunksize=?,sumenc=1,keygen=?,filekey=?,format=? where rowid=?", w.cs, fc.keys.gen, fc.wrapped, fc.format, rowid); err != nil {
+		return nil, err
+	}
+	fs.releasePacked(rowid)
+	return fc, nil
+}
+
+// releasePacked takes file rowid out of its pack, a pack nothing is in
+// anymore is removed.
+func (fs *ffs) releasePacked(rowid uint64) {
+	var pack uint64
+	if fs.DB.QueryRow("select pack from packed where rowid=?", rowid).Scan(&pack) != nil {
+		return
+	}
+	fs.DB.Exec("delete from packed where rowid=?", rowid)
+	var n int
+	fs.DB.QueryRow("select count(*) from packed where pack=?", pack).Scan(&n)
+	if n == 0 {
+		fs.removeObject(pack)
+	}
+}
+
+// compactPacks writes the files of packs that are less than half in use to
+// new packs and removes the old ones, packs nothing is in are removed.
+func (fs *ffs) compactPacks() error {
+	rows, err := fs.DB.Query("select rowid,fsize,(select ifnull(sum(size),0) from packed where pack=items.rowid) from items where parentid=?", packParent)
+	if err != nil {
+		return err
+	}
+	var sparse, empty []uint64
+	for rows.Next() {
+		var pack uint64
+		var fsize, used int64
+		rows.Scan(&pack, &fsize, &used)
+		if used == 0 {
+			empty = append(empty, pack)
+		} else if used*2 < fsize {
+			sparse = append(sparse, pack)
+		}
+	}
+	rows.Close()
+	for _, pack := range empty {
+		fs.removeObject(pack)
+	}
+	if len(sparse) == 0 {
+		return nil
+	}
+	var rowids []uint64
+	for _, pack := range sparse {
+		rows, err := fs.DB.Query("select rowid from packed where pack=? order by ofst", pack)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var rowid uint64
+			rows.Scan(&rowid)
+			rowids = append(rowids, rowid)
+		}
+		rows.Close()
+	}
+	for len(rowids) > 0 {
+		var batch []uint64
+		var size int64
+		for len(rowids) > 0 && size < fs.maxPackSize() {
+			_, e, _ := fs.packEntryOf(rowids[0])
+			batch = append(batch, rowids[0])
+			size += e.size
+			rowids = rowids[1:]
+		}
+		pack, entries, err := fs.writePack(batch, fs.readPacked, nil)
+		if err != nil {
+			return err
+		}
+		if len(entries) < len(batch) {
+			// the old packs keep the files that could not be read
+			return fmt.Errorf("%d files of the packs could not be read", len(batch)-len(entries))
+		}
+		log.Printf("%d files compacted in pack %d \n", len(entries), pack)
+	}
+	for _, pack := range sparse {
+		fs.removeObject(pack)
+	}
+	return nil
+}
+
+// gcPacks packs every file that is small enough and compacts the packs.
+func (fs *ffs) gcPacks() error {
+	for {
+		n, err := fs.packFiles(1)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return fs.compactPacks()
+}
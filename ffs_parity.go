@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// storedFile is a file row the maintenance commands walk over, a file with
+// shards of its own, a chunk object or a pack.
+type storedFile struct {
+	rowid     uint64
+	fsize     int64
+	fullpath  string
+	chunkSize int
+	keyGen    int
+	fileKey   []byte
+	format    int
+}
+
+// listFiles returns every file after rowid. The rows are read up front, so
+// the caller can update the database while it walks over them.
+func (fs *ffs) listFiles(after uint64) ([]storedFile, error) {
+	rows, err := fs.DB.Query("select rowid,fsize,fullpath,chunksize,keygen,filekey,format from items where isFolder=false and deduped=0 and packed=0 and inline is null and rowid>? order by rowid", after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []storedFile
+	for rows.Next() {
+		var f storedFile
+		rows.Scan(&f.rowid, &f.fsize, &f.fullpath, &f.chunkSize, &f.keyGen, &f.fileKey, &f.format)
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// findFile returns the row of file rowid.
+func (fs *ffs) findFile(rowid uint64) (storedFile, error) {
+	var f storedFile
+	err := fs.DB.QueryRow("select rowid,fsize,fullpath,chunksize,keygen,filekey,format from items where rowid=?", rowid).Scan(&f.rowid, &f.fsize, &f.fullpath, &f.chunkSize, &f.keyGen, &f.fileKey, &f.format)
+	return f, err
+}
+
+// readStored returns the content of a file with shards of its own.
+func (fs *ffs) readStored(f storedFile) ([]byte, error) {
+	fc, err := fs.cryptOf(f)
+	if err != nil {
+		return nil, err
+	}
+	if f.chunkSize == 0 {
+		return fs.readData(f.rowid, fc.keys, f.fsize)
+	}
+	data := make([]byte, 0, f.fsize)
+	for n := int64(0); n < fs.stripeCount(f.fsize, f.chunkSize); n++ {
+		buf, err := fs.readStripe(fc, f.fsize, f.chunkSize, n)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, buf...)
+	}
+	return data, nil
+}
+
+// providers lists every folder that holds shards, the sources first.
+func (fs *ffs) providers() []string {
+	return append(append([]string{}, fs.folders...), fs.csFolders...)
+}
+
+// shardFolder is the index in providers() of the folder that holds shard s
+// (data shards first, then parity shards) of file rowid. With the rotating
+// layout every file starts at a different provider, so parity is spread over
+// all of them instead of living in the checksum folders.
+func (fs *ffs) shardFolder(rowid uint64, s int) int {
+	if fs.rotating {
+		n := len(fs.folders)
+		return (s + int(rowid%uint64(n))) % n
+	}
+	if s < fs.dataShards {
+		return s
+	}
+	return len(fs.folders) + (s-fs.dataShards)%len(fs.csFolders)
+}
+
+// shardName is the suffix of shard s, the first parity shard keeps the old .sum name.
+func (fs *ffs) shardName(s int) string {
+	if s < fs.dataShards {
+		return fmt.Sprintf("dat%d", s)
+	}
+	if s == fs.dataShards {
+		return "sum"
+	}
+	return fmt.Sprintf("sum%d", s-fs.dataShards)
+}
+
+// shardPath returns the full path of shard s of file rowid.
+func (fs *ffs) shardPath(rowid uint64, s int) string {
+	return filepath.Join(fs.providers()[fs.shardFolder(rowid, s)], fmt.Sprintf("%s.%s", fs.fileName(rowid), fs.shardName(s)))
+}
+
+// partPath returns the full path of the i'th data part of file rowid.
+func (fs *ffs) partPath(rowid uint64, i int) string {
+	return fs.shardPath(rowid, i)
+}
+
+// sumPath returns the full path of parity shard j of file rowid.
+func (fs *ffs) sumPath(rowid uint64, j int) string {
+	return fs.shardPath(rowid, fs.dataShards+j)
+}
+
+// partSize is the stripe length Flush uses when it splits size bytes over the data shards.
+func (fs *ffs) partSize(size int64) int {
+	n := int64(fs.dataShards)
+	return int((size + n - 1) / n)
+}
+
+// partLen is the number of real file bytes stored in part i.
+func (fs *ffs) partLen(size int64, i int) int {
+	ps := int64(fs.partSize(size))
+	l := size - int64(i)*ps
+	if l < 0 {
+		return 0
+	}
+	if l > ps {
+		return int(ps)
+	}
+	return int(l)
+}
+
+// stripe returns the bytes of data that belong to part i when parts are ps bytes long.
+func stripe(data []byte, i int, ps int) []byte {
+	lo, hi := i*ps, (i+1)*ps
+	if lo > len(data) {
+		lo = len(data)
+	}
+	if hi > len(data) {
+		hi = len(data)
+	}
+	return data[lo:hi]
+}
+
+// padTo returns b zero padded (or cut) to exactly n bytes.
+func padTo(b []byte, n int) []byte {
+	r := make([]byte, n)
+	copy(r, b)
+	return r
+}
+
+// parity returns the parity shards of data, this is what goes into the .sum files.
+func (fs *ffs) parity(data []byte, ps int) [][]byte {
+	shards := make([][]byte, fs.dataShards)
+	for i := range shards {
+		shards[i] = padTo(stripe(data, i, ps), ps)
+	}
+	return fs.erasure.encode(shards)
+}
+
+// readPart reads and decrypts one data part. A part that can not be read or
+// decrypts to fewer bytes than it should hold is reported as an error.
+func (fs *ffs) readPart(rowid uint64, keys volumeKeys, i int, size int64) ([]byte, error) {
+	encBytes, err := ioutil.ReadFile(fs.partPath(rowid, i))
+	if err != nil {
+		return nil, err
+	}
+	openData := nlib.Decrypt(encBytes, keys.data)
+	if len(openData) < fs.partLen(size, i) {
+		return nil, fmt.Errorf("part %d decrypted to %d bytes, expected %d", i, len(openData), fs.partLen(size, i))
+	}
+	return openData, nil
+}
+
+// sumEncrypted tells if the parity of rowid is encrypted. Files written
+// before parity was encrypted keep plain parity until they are written again
+// or repaired by scrub.
+func (fs *ffs) sumEncrypted(rowid uint64) bool {
+	var sumenc bool
+	fs.DB.QueryRow("select sumenc from items where rowid=?", rowid).Scan(&sumenc)
+	return sumenc
+}
+
+// readSum reads parity shard j, it must be exactly one part long.
+func (fs *ffs) readSum(rowid uint64, keys volumeKeys, j int, size int64, encrypted bool) ([]byte, error) {
+	csum, err := ioutil.ReadFile(fs.sumPath(rowid, j))
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		csum = nlib.Decrypt(csum, keys.sum)
+	}
+	if len(csum) != fs.partSize(size) {
+		return nil, fmt.Errorf("parity %d is %d bytes, expected %d", j, len(csum), fs.partSize(size))
+	}
+	return csum, nil
+}
+
+// readData loads the whole content of file rowid. Parts that are missing or
+// broken are rebuilt from the surviving parts and the parity shards.
+func (fs *ffs) readData(rowid uint64, keys volumeKeys, size int64) ([]byte, error) {
+	filename := fs.fileName(rowid)
+	ps := fs.partSize(size)
+	shards := make([][]byte, fs.dataShards+fs.parityShards)
+	missing := 0
+	for i := 0; i < fs.dataShards; i++ {
+		part, err := fs.readPart(rowid, keys, i, size)
+		if err != nil {
+			log.Printf(nlib.BashFontColor_RED+"part %d of %s is not readable: %s"+nlib.BashFontColor_RESET, i, filename, err)
+			missing++
+			continue
+		}
+		shards[i] = padTo(part, ps)
+	}
+	if missing > fs.parityShards {
+		return nil, errTooManyMissing
+	}
+	if missing > 0 {
+		encrypted := fs.sumEncrypted(rowid)
+		for j := 0; j < fs.parityShards; j++ {
+			csum, err := fs.readSum(rowid, keys, j, size, encrypted)
+			if err != nil {
+				log.Printf(nlib.BashFontColor_RED+"parity %d of %s is not readable: %s"+nlib.BashFontColor_RESET, j, filename, err)
+				continue
+			}
+			shards[fs.dataShards+j] = csum
+		}
+		if err := fs.erasure.reconstruct(shards); err != nil {
+			return nil, err
+		}
+		log.Printf(nlib.BashFontColor_YELLOW+"%d parts of %s rebuilt from parity"+nlib.BashFontColor_RESET, missing, filename)
+	}
+
+	data := make([]byte, 0, size)
+	for i := 0; i < fs.dataShards; i++ {
+		data = append(data, shards[i][:fs.partLen(size, i)]...)
+	}
+	return data, nil
+}
+
+// loadFile reads the content of an open file into file.Data.
+func (fs *ffs) loadFile(file *ffs_File, rowid uint64) error {
+	if file.Size > 0 {
+		data, err := fs.readData(rowid, file.Crypt.keys, file.Size)
+		if err != nil {
+			return err
+		}
+		file.Data = data
+	}
+	file.Loaded = true
+	return nil
+}
+
+// writeSum writes parity shard j, encrypted with its own key unless the file
+// still has plain parity.
+func (fs *ffs) writeSum(rowid uint64, keys volumeKeys, j int, csum []byte, encrypted bool) error {
+	if encrypted {
+		csum = nlib.Encrypt(csum, keys.sum)
+	}
+	return writeFileAtomic(fs.sumPath(rowid, j), csum)
+}
+
+// writeParity writes all parity shards of data encrypted.
+func (fs *ffs) writeParity(rowid uint64, keys volumeKeys, data []byte, ps int) error {
+	for j, csum := range fs.parity(data, ps) {
+		if err := fs.writeSum(rowid, keys, j, csum, true); err != nil {
+			return err
+		}
+	}
+	_, err := fs.DB.Exec("update items set sumenc=1 where rowid=?", rowid)
+	return err
+}
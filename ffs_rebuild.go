@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nuveusltd/nlib"
+)
+
+const rebuildStateFile = ".ffs_rebuild"
+
+// writeFileAtomic writes data next to filename and renames it into place, so
+// an interrupted write never leaves a half written part behind.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// copyFile copies src to dst through a temporary file.
+func copyFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, data)
+}
+
+// rebuild regenerates every shard that belonged to folder index into target,
+// using the surviving parts and the parity shards. Indexes after the last
+// source are the checksum folders. The last rowid that was finished without
+// errors is kept in target/.ffs_rebuild, so an interrupted rebuild continues
+// where it stopped when it is started again with the same arguments. The
+// first source is rebuilt like any other, the database comes from the cache
+// folder or from the metadata replica of a surviving folder.
+func (fs *ffs) rebuild(index int, target string) error {
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return err
+	}
+	var lost string
+	if index < len(fs.folders) {
+		lost = fs.folders[index]
+		fs.folders[index] = target
+	} else {
+		lost = fs.csFolders[index-len(fs.folders)]
+		fs.csFolders[index-len(fs.folders)] = target
+	}
+
+	if err := fs.writeSuperblock(index); err != nil {
+		return err
+	}
+	// the next sync writes the metadata replica of target, even when the
+	// database did not change
+	fs.metaSum = [32]byte{}
+
+	statefile := filepath.Join(target, rebuildStateFile)
+	var lastid uint64
+	if b, err := ioutil.ReadFile(statefile); err == nil {
+		lastid, _ = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		log.Printf("Resuming rebuild of %s after item %d \n", lost, lastid)
+	}
+
+	// only the files listFiles gives have shards to rebuild
+	var done int
+	fs.DB.QueryRow("select count(*) from items where isFolder=false and deduped=0 and packed=0 and inline is null and rowid<=?", lastid).Scan(&done)
+	files, err := fs.listFiles(lastid)
+	if err != nil {
+		return err
+	}
+	total := done + len(files)
+	failed := 0
+	for _, f := range files {
+		done++
+		if err := fs.rebuildFile(f, index); err != nil {
+			failed++
+			log.Printf(nlib.BashFontColor_RED+"rebuild %d/%d %s failed: %s"+nlib.BashFontColor_RESET, done, total, f.fullpath, err)
+		} else {
+			log.Printf("rebuild %d/%d (%d%%) %s", done, total, done*100/total, f.fullpath)
+		}
+		if failed == 0 {
+			ioutil.WriteFile(statefile, []byte(strconv.FormatUint(f.rowid, 10)), 0644)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be rebuilt", failed, total)
+	}
+	os.Remove(statefile)
+	log.Printf("Folder %s is rebuilt in %s \n", lost, target)
+	return nil
+}
+
+// rebuildFile recovers the content of rowid and writes the shards that
+// belong to folder index again.
+func (fs *ffs) rebuildFile(f storedFile, index int) error {
+	rowid, fsize := f.rowid, f.fsize
+	fc, err := fs.cryptOf(f)
+	if err != nil {
+		return err
+	}
+	keys := fc.keys
+	if f.chunkSize > 0 {
+		fs.createFileName(rowid)
+		for n := int64(0); n < fs.stripeCount(fsize, f.chunkSize); n++ {
+			if fs.isHole(rowid, n) {
+				continue
+			}
+			buf, err := fs.readStripe(fc, fsize, f.chunkSize, n)
+			if err != nil {
+				return err
+			}
+			if err := fs.writeStripe(fc, f.chunkSize, n, buf, index); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	data, err := fs.readData(rowid, keys, fsize)
+	if err != nil {
+		return err
+	}
+	fs.createFileName(rowid)
+	ps := fs.partSize(fsize)
+	for i := 0; i < fs.dataShards; i++ {
+		if fs.shardFolder(rowid, i) != index {
+			continue
+		}
+		if err := writeFileAtomic(fs.partPath(rowid, i), nlib.Encrypt(stripe(data, i, ps), keys.data)); err != nil {
+			return err
+		}
+	}
+	encrypted := fs.sumEncrypted(rowid)
+	for j, csum := range fs.parity(data, ps) {
+		if fs.shardFolder(rowid, fs.dataShards+j) != index {
+			continue
+		}
+		if err := fs.writeSum(rowid, keys, j, csum, encrypted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
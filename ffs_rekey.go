@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Rekey
+//
+// A rekey moves every file to the newest key set of the ring. A file is read
+// with its own keys and written with a new file key under the new set into
+// shard files next to the old ones, which replace the old shards together
+// with items.keygen and items.filekey, see ffs_swap.go. Files that are
+// opened, truncated or removed meanwhile are done again later, so a mounted
+// volume keeps working while the rekey runs in the background. Files of the
+// whole part format are moved to stripes on the way. An interrupted rekey
+// goes on where it stopped, a file it was swapping is finished when the
+// volume is opened again. When no file uses an older key set anymore those
+// sets are dropped from the ring, from then on the old master key and
+// password open nothing.
+
+var errFileBusy = errors.New("file changed while it was rekeyed")
+
+// startRekey puts a new key set in front of the ring and seals the ring with
+// a new master key. Only the slot the volume is unlocked with is kept, it
+// wraps the new master key under secret.
+func (fs *ffs) startRekey(secret string) error {
+	keys := randomKeys(fs.currentKeys().gen + 1)
+	name := ""
+	for _, slot := range fs.keys.Slots {
+		if slot.ID == fs.slot {
+			name = slot.Name
+		} else {
+			log.Printf(nlib.BashFontColor_YELLOW+"Key slot %d %s is dropped, add it again with addkey \n"+nlib.BashFontColor_RESET, slot.ID, slot.Name)
+		}
+	}
+	fs.master = randomKey()
+	fs.ring = append(keyRing{keys}, fs.ring...)
+	fs.keys = newKeyHeader(newKeySlot(fs.slot, name, secret, fs.master), fs.master, fs.ring, fs.keys.Generation+1)
+	if err := fs.writeSuperblocks(false); err != nil {
+		return err
+	}
+	fs.metaSum = [32]byte{}
+	log.Printf(nlib.BashFontColor_GREEN+"Rekey started, new key generation %d \n"+nlib.BashFontColor_RESET, keys.gen)
+	return nil
+}
+
+// rekeyPending tells if files may still use an older key set.
+func (fs *ffs) rekeyPending() bool {
+	return len(fs.ring) > 1
+}
+
+// touch tells a running rekey or dedup that file rowid is opened or changed.
+func (fs *ffs) touch(rowid uint64) {
+	if fs.rekeying == rowid {
+		fs.rekeyTouched = true
+	}
+	if fs.deduping == rowid {
+		fs.dedupTouched = true
+	}
+}
+
+// isOpen tells if file rowid is open.
+func (fs *ffs) isOpen(rowid uint64) bool {
+	for _, file := range openFiles {
+		if uint64(file.ID) == rowid {
+			return true
+		}
+	}
+	return false
+}
+
+// rekey writes every file that uses an older key set again with the current
+// one. Busy files are tried again after retry.
+func (fs *ffs) rekey(retry time.Duration) error {
+	cur := fs.currentKeys()
+	for {
+		files, err := fs.listFiles(0)
+		if err != nil {
+			return err
+		}
+		var todo []storedFile
+		for _, f := range files {
+			if f.keyGen != cur.gen {
+				todo = append(todo, f)
+			}
+		}
+		busy, err := fs.rekeyInline(cur)
+		if err != nil {
+			return err
+		}
+		if len(todo) == 0 && busy == 0 {
+			break
+		}
+		failed := 0
+		for i, f := range todo {
+			err := fs.rekeyFile(f, cur)
+			switch {
+			case err == errFileBusy:
+				busy++
+				log.Printf(nlib.BashFontColor_YELLOW+"rekey %d/%d %s is in use, it is done later"+nlib.BashFontColor_RESET, i+1, len(todo), f.fullpath)
+			case err != nil:
+				failed++
+				log.Printf(nlib.BashFontColor_RED+"rekey %d/%d %s failed: %s"+nlib.BashFontColor_RESET, i+1, len(todo), f.fullpath, err)
+			default:
+				log.Printf("rekey %d/%d (%d%%) %s", i+1, len(todo), (i+1)*100/len(todo), f.fullpath)
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d files could not be rekeyed", failed, len(todo))
+		}
+		if busy > 0 {
+			time.Sleep(retry)
+		}
+	}
+	return fs.finishRekey()
+}
+
+// rekeyFile writes file f again with a new file key under the key set cur.
+func (fs *ffs) rekeyFile(f storedFile, cur volumeKeys) error {
+	old, err := fs.cryptOf(f)
+	if err != nil {
+		return err
+	}
+	fc, err := fs.newFileCrypt(f.rowid, cur)
+	if err != nil {
+		return err
+	}
+	fc.compress = old.compress
+	fs.lock.Lock()
+	fs.rekeying, fs.rekeyTouched = f.rowid, false
+	busy := fs.isOpen(f.rowid)
+	fs.lock.Unlock()
+	if busy {
+		return fs.endRekeyFile(errFileBusy)
+	}
+
+	cs := f.chunkSize
+	var data []byte
+	if cs == 0 {
+		cs = fs.chunkSize
+		if f.fsize > 0 {
+			if data, err = fs.readData(f.rowid, old.keys, f.fsize); err != nil {
+				return fs.endRekeyFile(err)
+			}
+		}
+	}
+	var mac hash.Hash
+	if strings.HasPrefix(f.fullpath, chunkFolder) {
+		mac = newChunkHash(cur)
+	}
+	a := fs.newSlotAppender(fc, cs)
+	w := fs.stripeWidth(cs)
+	for n := int64(0); n < fs.stripeCount(f.fsize, cs); n++ {
+		var buf []byte
+		if f.chunkSize == 0 {
+			buf = stripe(data, int(n), int(w))
+		} else if buf, err = fs.readStripe(old, f.fsize, cs, n); err != nil {
+			fs.removeSwapShards(f.rowid)
+			return fs.endRekeyFile(err)
+		}
+		if mac != nil {
+			mac.Write(buf)
+		}
+		if f.chunkSize > 0 && fs.isHole(f.rowid, n) {
+			continue
+		}
+		if err := a.writeStripe(n, buf); err != nil {
+			fs.removeSwapShards(f.rowid)
+			return fs.endRekeyFile(err)
+		}
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.rekeying = 0
+	var gen int
+	if err := fs.DB.QueryRow("select keygen from items where rowid=?", f.rowid).Scan(&gen); err != nil || fs.rekeyTouched || gen != f.keyGen {
+		fs.removeSwapShards(f.rowid)
+		return errFileBusy
+	}
+	return fs.commitSwap(f.rowid, cs, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("update items set keygen=?,chunksize=?,sumenc=1,filekey=?,format=? where rowid=?", cur.gen, cs, fc.wrapped, fc.format, f.rowid); err != nil {
+			return err
+		}
+		if mac != nil {
+			// a chunk object is found by the hash under the new keys from now on
+			if _, err := tx.Exec("update chunks set hash=?,keygen=? where object=?", mac.Sum(nil), cur.gen, f.rowid); err != nil {
+				return err
+			}
+		}
+		return a.commit(tx)
+	})
+}
+
+// endRekeyFile clears the file the rekey works on and returns err.
+func (fs *ffs) endRekeyFile(err error) error {
+	fs.lock.Lock()
+	fs.rekeying = 0
+	fs.lock.Unlock()
+	return err
+}
+
+// finishRekey drops the older key sets once the replicas are written with
+// the current one.
+func (fs *ffs) finishRekey() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.syncMetadata(); err != nil {
+		return err
+	}
+	if !fs.rekeyPending() {
+		return nil
+	}
+	fs.ring = fs.ring[:1]
+	kh := *fs.keys
+	kh.Ring = sealKey(fs.master, fs.ring.marshal())
+	kh.Generation++
+	fs.keys = &kh
+	if err := fs.writeSuperblocks(false); err != nil {
+		return err
+	}
+	log.Printf(nlib.BashFontColor_GREEN+"Rekey finished, every file uses key generation %d \n"+nlib.BashFontColor_RESET, fs.currentKeys().gen)
+	return nil
+}
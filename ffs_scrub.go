@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// scrubProblem is one line of the scrub report.
+type scrubProblem struct {
+	Rowid     uint64 `json:"rowid"`
+	Path      string `json:"path"`
+	Component string `json:"component"` // dat0, dat1 ... sum, sum1 ...
+	Problem   string `json:"problem"`   // missing, header, truncated, decrypt, length, parity, unverifiable or plaintext
+	Detail    string `json:"detail,omitempty"`
+	Repaired  bool   `json:"repaired"`
+}
+
+// scrub checks the parts and the parity of every file and writes one JSON
+// line per problem to report. With repair the broken component is written
+// again from the good ones. A parity mismatch where every part decrypts is
+// repaired by trusting the parts and rewriting the parity shards. A missing
+// part is rebuilt only when a parity shard that was not used to rebuild it
+// agrees, otherwise it is reported as unverifiable and left as it is.
+func (fs *ffs) scrub(report io.Writer, repair bool) error {
+	files, err := fs.listFiles(0)
+	if err != nil {
+		return err
+	}
+	total := len(files)
+	enc := json.NewEncoder(report)
+	done, found, repaired := 0, 0, 0
+	for _, f := range files {
+		done++
+		var problems []scrubProblem
+		if f.chunkSize > 0 {
+			problems = fs.scrubStripes(f, repair)
+		} else {
+			problems = fs.scrubFile(f, repair)
+		}
+		for _, p := range problems {
+			found++
+			if p.Repaired {
+				repaired++
+			}
+			enc.Encode(p)
+		}
+		if done%100 == 0 || done == total {
+			log.Printf("scrub %d/%d files, %d problems, %d repaired", done, total, found, repaired)
+		}
+	}
+	if found > repaired {
+		return fmt.Errorf("%d problems found, %d repaired", found, repaired)
+	}
+	return nil
+}
+
+// scrubStripes verifies a file of the stripe format one stripe at a time
+// and optionally repairs the broken stripes.
+func (fs *ffs) scrubStripes(f storedFile, repair bool) []scrubProblem {
+	var problems []scrubProblem
+	cs := f.chunkSize
+	fc, err := fs.cryptOf(f)
+	if err != nil {
+		return []scrubProblem{{Rowid: f.rowid, Path: f.fullpath, Component: fs.shardName(0), Problem: "decrypt", Detail: err.Error()}}
+	}
+	for n := int64(0); n < fs.stripeCount(f.fsize, cs); n++ {
+		if fs.isHole(f.rowid, n) {
+			continue
+		}
+		var found []scrubProblem
+		add := func(s int, problem string, detail string) {
+			found = append(found, scrubProblem{Rowid: f.rowid, Path: f.fullpath, Component: fs.shardName(s), Problem: problem, Detail: fmt.Sprintf("stripe %d: %s", n, detail)})
+		}
+
+		l := fs.stripeLen(f.fsize, cs, n)
+		cl := chunkLen(l, cs, 0)
+		shards := make([][]byte, fs.dataShards+fs.parityShards)
+		for s := range shards {
+			want := cl
+			if s < fs.dataShards {
+				want = chunkLen(l, cs, s)
+			}
+			sealed, err := fs.readSlot(fc, s, cs, n)
+			if err != nil {
+				problem := "missing"
+				if errors.Is(err, errShardHeader) {
+					problem = "header"
+				} else if errors.Is(err, errShardTruncated) {
+					problem = "truncated"
+				}
+				add(s, problem, err.Error())
+				continue
+			}
+			chunk, err := fc.open(s, n, sealed.algo, sealed.data)
+			if err != nil {
+				add(s, "decrypt", err.Error())
+				continue
+			}
+			if len(chunk) != want {
+				problem := "decrypt"
+				if len(chunk) > want {
+					problem = "length"
+				}
+				add(s, problem, fmt.Sprintf("decrypted to %d bytes, expected %d", len(chunk), want))
+				continue
+			}
+			shards[s] = padTo(chunk, cl)
+		}
+		stale, err := fs.verifyShards(shards)
+		for _, s := range stale {
+			add(s, "parity", "parity does not match the chunks")
+		}
+		if err == errParityUnverified {
+			for s := 0; s < fs.dataShards; s++ {
+				if shards[s] == nil {
+					add(s, "unverifiable", err.Error())
+				}
+			}
+		}
+
+		if repair && len(found) > 0 && err == nil {
+			buf := make([]byte, 0, l)
+			for s := 0; s < fs.dataShards; s++ {
+				buf = append(buf, shards[s][:chunkLen(l, cs, s)]...)
+			}
+			if err := fs.writeStripe(fc, cs, n, buf, -1); err != nil {
+				log.Printf(nlib.BashFontColor_RED+"scrub can not repair stripe %d of %s: %s"+nlib.BashFontColor_RESET, n, f.fullpath, err)
+			} else {
+				for i := range found {
+					found[i].Repaired = true
+				}
+			}
+		}
+		problems = append(problems, found...)
+	}
+	return problems
+}
+
+// scrubFile verifies one file of the whole part format and optionally repairs it.
+func (fs *ffs) scrubFile(f storedFile, repair bool) []scrubProblem {
+	rowid, fsize, fullpath := f.rowid, f.fsize, f.fullpath
+	var problems []scrubProblem
+	add := func(component string, problem string, detail string) {
+		problems = append(problems, scrubProblem{Rowid: rowid, Path: fullpath, Component: component, Problem: problem, Detail: detail})
+	}
+
+	keys, err := fs.ring.get(f.keyGen)
+	if err != nil {
+		add(fs.shardName(0), "decrypt", err.Error())
+		return problems
+	}
+	ps := fs.partSize(fsize)
+	parts := make([][]byte, fs.dataShards)
+	for i := range parts {
+		component := fs.shardName(i)
+		encBytes, err := ioutil.ReadFile(fs.partPath(rowid, i))
+		if err != nil {
+			add(component, "missing", err.Error())
+			continue
+		}
+		part := nlib.Decrypt(encBytes, keys.data)
+		if len(part) < fs.partLen(fsize, i) {
+			add(component, "decrypt", fmt.Sprintf("decrypted to %d bytes, expected %d of %d", len(part), fs.partLen(fsize, i), fsize))
+			continue
+		}
+		if len(part) > fs.partLen(fsize, i) {
+			add(component, "length", fmt.Sprintf("decrypted to %d bytes, expected %d of %d", len(part), fs.partLen(fsize, i), fsize))
+		}
+		parts[i] = part
+	}
+
+	encrypted := fs.sumEncrypted(rowid)
+	if !encrypted {
+		add(fs.shardName(fs.dataShards), "plaintext", "parity is not encrypted")
+	}
+	csums := make([][]byte, fs.parityShards)
+	for j := range csums {
+		csum, err := ioutil.ReadFile(fs.sumPath(rowid, j))
+		if err != nil {
+			add(fs.shardName(fs.dataShards+j), "missing", err.Error())
+			continue
+		}
+		if encrypted {
+			csum = nlib.Decrypt(csum, keys.sum)
+		}
+		if len(csum) != ps {
+			problem := "length"
+			if encrypted {
+				problem = "decrypt"
+			}
+			add(fs.shardName(fs.dataShards+j), problem, fmt.Sprintf("%d bytes, expected %d", len(csum), ps))
+			continue
+		}
+		csums[j] = csum
+	}
+	shards := make([][]byte, fs.dataShards+fs.parityShards)
+	for i, part := range parts {
+		if part != nil {
+			shards[i] = padTo(part, ps)
+		}
+	}
+	copy(shards[fs.dataShards:], csums)
+	stale, err := fs.verifyShards(shards)
+	for _, s := range stale {
+		add(fs.shardName(s), "parity", "parity does not match the parts")
+	}
+	if err == errParityUnverified {
+		for i := range parts {
+			if parts[i] == nil {
+				add(fs.shardName(i), "unverifiable", err.Error())
+			}
+		}
+	}
+
+	if !repair || len(problems) == 0 || err != nil {
+		return problems
+	}
+	data := make([]byte, 0, fsize)
+	for i := range parts {
+		data = append(data, shards[i][:fs.partLen(fsize, i)]...)
+	}
+	fs.createFileName(rowid)
+	for i := range parts {
+		if parts[i] != nil && len(parts[i]) == fs.partLen(fsize, i) {
+			continue
+		}
+		if err := writeFileAtomic(fs.partPath(rowid, i), nlib.Encrypt(stripe(data, i, ps), keys.data)); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"scrub can not write part %d of %s: %s"+nlib.BashFontColor_RESET, i, fullpath, err)
+			return problems
+		}
+	}
+	if err := fs.writeParity(rowid, keys, data, ps); err != nil {
+		log.Printf(nlib.BashFontColor_RED+"scrub can not write parity of %s: %s"+nlib.BashFontColor_RESET, fullpath, err)
+		return problems
+	}
+	for i := range problems {
+		problems[i].Repaired = true
+	}
+	return problems
+}
+
+var errParityUnverified = errors.New("no spare shard to check the parity the missing chunks would be rebuilt from")
+
+// verifyShards fills the missing data shards of shards (k data shards
+// followed by m parity shards, nil when missing) and returns the parity
+// shards that do not match the data. Every choice of parity shards to
+// rebuild from is tried, a choice is good when a parity shard that was not
+// used agrees with the result, so a stale parity shard is never taken for
+// the data. It fails with errParityUnverified when no parity shard is left
+// over to check with.
+func (fs *ffs) verifyShards(shards [][]byte) ([]int, error) {
+	k := fs.dataShards
+	missing := 0
+	var present []int
+	for s, shard := range shards {
+		if s < k && shard == nil {
+			missing++
+		} else if s >= k && shard != nil {
+			present = append(present, s)
+		}
+	}
+	mismatches := func(data [][]byte) []int {
+		var stale []int
+		for j, csum := range fs.erasure.encode(data[:k]) {
+			if shards[k+j] != nil && !bytes.Equal(shards[k+j], csum) {
+				stale = append(stale, k+j)
+			}
+		}
+		return stale
+	}
+	if missing == 0 {
+		return mismatches(shards), nil
+	}
+	if len(present) < missing {
+		return nil, errTooManyMissing
+	}
+	if len(present) == missing {
+		return nil, errParityUnverified
+	}
+
+	var best [][]byte
+	var bestStale []int
+	used := make([]int, 0, missing)
+	var try func(from int)
+	try = func(from int) {
+		if len(used) < missing {
+			for i := from; i < len(present); i++ {
+				used = append(used, present[i])
+				try(i + 1)
+				used = used[:len(used)-1]
+			}
+			return
+		}
+		data := make([][]byte, len(shards))
+		copy(data, shards[:k])
+		for _, s := range used {
+			data[s] = shards[s]
+		}
+		if fs.erasure.reconstruct(data) != nil {
+			return
+		}
+		// the parity shards used always match, one more has to
+		stale := mismatches(data)
+		if len(stale) < len(present)-missing && (best == nil || len(stale) < len(bestStale)) {
+			best, bestStale = data, stale
+		}
+	}
+	try(0)
+	if best == nil {
+		return nil, errParityUnverified
+	}
+	copy(shards[:k], best[:k])
+	return bestStale, nil
+}
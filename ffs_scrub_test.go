@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestVerifyShards checks that a missing data shard is rebuilt only from
+// parity another parity shard agrees with.
+func TestVerifyShards(t *testing.T) {
+	fs := &ffs{dataShards: 2, parityShards: 3, erasure: newErasure(2, 3)}
+	data := [][]byte{make([]byte, 64), make([]byte, 64)}
+	rand.Read(data[0])
+	rand.Read(data[1])
+	parity := fs.erasure.encode(data)
+	stripe := func() [][]byte {
+		shards := [][]byte{nil, data[1]}
+		for _, p := range parity {
+			shards = append(shards, append([]byte{}, p...))
+		}
+		return shards
+	}
+
+	shards := stripe()
+	if stale, err := fs.verifyShards(shards); err != nil || len(stale) != 0 || !bytes.Equal(shards[0], data[0]) {
+		t.Fatal("rebuild", stale, err)
+	}
+	for s := 2; s < 5; s++ {
+		shards = stripe()
+		shards[s][5] ^= 1
+		stale, err := fs.verifyShards(shards)
+		if err != nil || len(stale) != 1 || stale[0] != s || !bytes.Equal(shards[0], data[0]) {
+			t.Fatalf("stale parity %d: %v %v", s, stale, err)
+		}
+	}
+
+	// with one spare a mismatch does not tell which parity shard is stale
+	shards = stripe()
+	shards[4] = nil
+	shards[2][5] ^= 1
+	if _, err := fs.verifyShards(shards); err != errParityUnverified || shards[0] != nil {
+		t.Fatal("one spare parity shard", err)
+	}
+	shards = stripe()
+	shards[3], shards[4] = nil, nil
+	if _, err := fs.verifyShards(shards); err != errParityUnverified {
+		t.Fatal("no spare parity shard", err)
+	}
+	shards = stripe()
+	shards[1], shards[3], shards[4] = nil, nil, nil
+	if _, err := fs.verifyShards(shards); err != errTooManyMissing {
+		t.Fatal("too many missing", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Slot index
+//
+// Files of format 13 and newer store their shard files densely: a shard file
+// holds only the slots of the stripes that are stored, each one just as long
+// as its sealed chunk, in the order they were first written. The slots table
+// gives the offset and the capacity of the slot of every stored stripe of
+// every shard. A chunk that is written again stays in its slot when it fits,
+// the last slot of a shard file grows in place and any other slot moves to
+// the end of the shard file. Slots that are dropped at the end of a shard
+// file, when the file shrinks or its last stripes become holes, are cut off.
+// The space of a slot that moved or became a hole in the middle of a shard
+// file is only given back when a rekey writes the file again. Older files
+// keep a slot of fixed size for every stripe, see slotOffset.
+
+const denseSlotFormat = 13
+
+// slotRef is where a slot of a dense shard file is.
+type slotRef struct {
+	ofst int64
+	cap  int64
+}
+
+// dense tells if the file of fc has a slot index.
+func (fc *fileCrypt) dense() bool {
+	return fc.format >= denseSlotFormat
+}
+
+// findSlot returns the slot of stripe n of shard s of file rowid.
+func (fs *ffs) findSlot(rowid uint64, s int, n int64) (slotRef, bool) {
+	var ref slotRef
+	err := fs.DB.QueryRow("select ofst,cap from slots where rowid=? and shard=? and stripe=?", rowid, s, n).Scan(&ref.ofst, &ref.cap)
+	return ref, err == nil
+}
+
+// slotsEnd is the end of the last slot of shard s of file rowid.
+func (fs *ffs) slotsEnd(rowid uint64, s int) int64 {
+	end := int64(shardHeaderSize)
+	fs.DB.QueryRow("select coalesce(max(ofst+cap),?) from slots where rowid=? and shard=?", shardHeaderSize, rowid, s).Scan(&end)
+	return end
+}
+
+// placeSlot returns the slot a chunk of size bytes of stripe n of shard s is
+// written to and tells if the index has to record it.
+func (fs *ffs) placeSlot(rowid uint64, s int, n int64, size int64) (slotRef, bool) {
+	ref, found := fs.findSlot(rowid, s, n)
+	if found && size <= ref.cap {
+		return ref, false
+	}
+	end := fs.slotsEnd(rowid, s)
+	if !found || ref.ofst+ref.cap != end {
+		ref.ofst = end
+	}
+	ref.cap = size
+	return ref, true
+}
+
+func (fs *ffs) recordSlot(rowid uint64, s int, n int64, ref slotRef) error {
+	_, err := fs.DB.Exec("INSERT OR REPLACE into slots(rowid,shard,stripe,ofst,cap) VALUES (?,?,?,?,?)", rowid, s, n, ref.ofst, ref.cap)
+	return err
+}
+
+// dropSlots forgets the slots of the stripes first to last of file rowid and
+// cuts the shard files after their last remaining slot.
+func (fs *ffs) dropSlots(rowid uint64, first int64, last int64) error {
+	if _, err := fs.DB.Exec("delete from slots where rowid=? and stripe>=? and stripe<=?", rowid, first, last); err != nil {
+		return err
+	}
+	for s := 0; s < fs.dataShards+fs.parityShards; s++ {
+		filename := fs.shardPath(rowid, s)
+		if st, err := os.Stat(filename); err == nil && st.Size() > fs.slotsEnd(rowid, s) {
+			if err := os.Truncate(filename, fs.slotsEnd(rowid, s)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putSlot writes sealed at ofst of filename, a new shard file gets its header
+// first.
+func (fs *ffs) putSlot(filename string, fc *fileCrypt, s int, cs int, ofst int64, sealed sealedChunk) error {
+	if len(sealed.data) >= 1<<slotLenBits {
+		return fmt.Errorf("chunk of %d bytes does not fit in a slot", len(sealed.data))
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil {
+		return err
+	} else if st.Size() < shardHeaderSize {
+		if _, err := f.WriteAt(fs.shardHeader(fc.rowid, s, cs), 0); err != nil {
+			return err
+		}
+	}
+	b := make([]byte, slotHeader+len(sealed.data))
+	binary.BigEndian.PutUint32(b, uint32(sealed.algo)<<slotLenBits|uint32(len(sealed.data)))
+	copy(b[slotHeader:], sealed.data)
+	_, err = f.WriteAt(b, ofst)
+	return err
+}
+
+// slotAppender writes the slots of a file that is written again into new
+// shard files, see ffs_swap.go. Its slot index replaces the one of the file
+// in the transaction of the swap.
+type slotAppender struct {
+	fs    *ffs
+	fc    *fileCrypt
+	cs    int
+	ends  map[int]int64
+	slots []slotEntry
+}
+
+type slotEntry struct {
+	s   int
+	n   int64
+	ref slotRef
+}
+
+func (fs *ffs) newSlotAppender(fc *fileCrypt, cs int) *slotAppender {
+	fs.removeSwapShards(fc.rowid)
+	fs.createFileName(fc.rowid)
+	return &slotAppender{fs: fs, fc: fc, cs: cs, ends: map[int]int64{}}
+}
+
+// write stores sealed as stripe n of shard s.
+func (a *slotAppender) write(s int, n int64, sealed sealedChunk) error {
+	filename := a.fs.swapPath(a.fc.rowid, s)
+	if !a.fc.dense() {
+		return a.fs.putSlot(filename, a.fc, s, a.cs, slotOffset(a.fc, a.cs, n), sealed)
+	}
+	ref := slotRef{ofst: a.ends[s], cap: int64(slotHeader + len(sealed.data))}
+	if ref.ofst == 0 {
+		ref.ofst = shardHeaderSize
+	}
+	if err := a.fs.putSlot(filename, a.fc, s, a.cs, ref.ofst, sealed); err != nil {
+		return err
+	}
+	a.ends[s] = ref.ofst + ref.cap
+	a.slots = append(a.slots, slotEntry{s: s, n: n, ref: ref})
+	return nil
+}
+
+// writeStripe seals stripe n and writes its chunks.
+func (a *slotAppender) writeStripe(n int64, buf []byte) error {
+	for s, sealed := range a.fs.sealStripe(a.fc, a.cs, n, buf) {
+		if err := a.write(s, n, sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commit replaces the slot index of the file in tx.
+func (a *slotAppender) commit(tx *sql.Tx) error {
+	if _, err := tx.Exec("delete from slots where rowid=?", a.fc.rowid); err != nil {
+		return err
+	}
+	for _, e := range a.slots {
+		if _, err := tx.Exec("insert into slots(rowid,shard,stripe,ofst,cap) VALUES (?,?,?,?,?)", a.fc.rowid, e.s, e.n, e.ref.ofst, e.ref.cap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
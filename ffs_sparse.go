@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sparse files
+//
+// A stripe that holds only zeros is not stored, the holes table marks it
+// instead and readers return zeros for it without touching the providers.
+// Writing past the end of a file or extending it with Truncate leaves holes
+// for the stripes in between, and a stripe that is written with zeros only
+// becomes a hole. Shard files of format 13 and newer have slots only for the
+// stored stripes, so disk images and preallocated files cost only the
+// stripes that have data, see ffs_slots.go. The slots of a stripe that
+// becomes a hole are given back when they are at the end of the shard
+// files, otherwise when a rekey writes the file again. Older files keep a
+// fixed slot for every stripe, there a hole saves the space only when the
+// shard file system is sparse too.
+//
+// The holes are in the database, whose replicas are sealed, so a slot that
+// is cut out of a shard file is reported like before and never read as
+// zeros. FUSE through cgofuse has no lseek, so SEEK_DATA and SEEK_HOLE see
+// the whole file as data. Getattr counts only the stored stripes in
+// st_blocks, which cp --sparse and du take as holes, and the holesXattr
+// attribute lists the holes as start-end byte ranges.
+
+const holesXattr = "user.ffs.holes"
+
+// isZero tells if b holds only zeros.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isHole tells if stripe n of file rowid is a hole.
+func (fs *ffs) isHole(rowid uint64, n int64) bool {
+	var hole int
+	fs.DB.QueryRow("select count(*) from holes where rowid=? and stripe=?", rowid, n).Scan(&hole)
+	return hole > 0
+}
+
+// setHole marks stripe n of file rowid as a hole or as stored.
+func (fs *ffs) setHole(rowid uint64, n int64, hole bool) error {
+	var err error
+	if hole {
+		_, err = fs.DB.Exec("INSERT OR IGNORE into holes(rowid,stripe) VALUES (?,?)", rowid, n)
+	} else {
+		_, err = fs.DB.Exec("delete from holes where rowid=? and stripe=?", rowid, n)
+	}
+	return err
+}
+
+// putStripe stores stripe n, a stripe of zeros becomes a hole.
+func (fs *ffs) putStripe(fc *fileCrypt, cs int, n int64, buf []byte) error {
+	if isZero(buf) {
+		if err := fs.setHole(fc.rowid, n, true); err != nil || !fc.dense() {
+			return err
+		}
+		return fs.dropSlots(fc.rowid, n, n)
+	}
+	if err := fs.writeStripe(fc, cs, n, buf, -1); err != nil {
+		return err
+	}
+	return fs.setHole(fc.rowid, n, false)
+}
+
+// storedBlocks is the number of 512 byte blocks file rowid of size bytes
+// has, its holes left out.
+func (fs *ffs) storedBlocks(rowid uint64, size int64, cs int) int64 {
+	stored := size
+	if cs > 0 {
+		rows, err := fs.DB.Query("select stripe from holes where rowid=?", rowid)
+		if err == nil {
+			for rows.Next() {
+				var n int64
+				rows.Scan(&n)
+				stored -= int64(fs.stripeLen(size, cs, n))
+			}
+			rows.Close()
+		}
+	}
+	return (stored + 511) / 512
+}
+
+// holeList returns the holes of file rowid of size bytes as start-end byte
+// ranges, neighbouring holes are joined.
+func (fs *ffs) holeList(rowid uint64, size int64, cs int) string {
+	rows, err := fs.DB.Query("select stripe from holes where rowid=? order by stripe", rowid)
+	if err != nil {
+		return ""
+	}
+	defer rows.Close()
+	w := fs.stripeWidth(cs)
+	var ranges []string
+	start, end := int64(-1), int64(-1)
+	for rows.Next() {
+		var n int64
+		rows.Scan(&n)
+		if n*w != end {
+			if start >= 0 {
+				ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+			}
+			start = n * w
+		}
+		end = (n + 1) * w
+		if end > size {
+			end = size
+		}
+	}
+	if start >= 0 {
+		ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+	}
+	return strings.Join(ranges, ",")
+}
+
+// extendFile makes an open file size bytes long, the stripes after its old
+// last stripe are holes.
+func (fs *ffs) extendFile(file *ffs_File, size int64) error {
+	if file.Inline {
+		file.Size = size
+		if fs.inlines(file) {
+			return fs.inlineFile(file)
+		}
+		file.Dirty = true
+	}
+	if err := fs.flushStripe(file); err != nil {
+		return err
+	}
+	rowid := uint64(file.ID)
+	cs := file.ChunkSize
+	w := fs.stripeWidth(cs)
+	fs.createFileName(rowid)
+	stored := fs.stripeCount(file.Stored, cs)
+	if stored > 0 && file.Stored%w != 0 && !fs.isHole(rowid, stored-1) {
+		buf, err := fs.readStripe(file.Crypt, file.Stored, cs, stored-1)
+		if err != nil {
+			return err
+		}
+		if err := fs.putStripe(file.Crypt, cs, stored-1, padTo(buf, fs.stripeLen(size, cs, stored-1))); err != nil {
+			return err
+		}
+	}
+	for n := stored; n < fs.stripeCount(size, cs); n++ {
+		if err := fs.setHole(rowid, n, true); err != nil {
+			return err
+		}
+	}
+	if _, err := fs.DB.Exec("update items set fsize=?,mdate=?,inline=null where rowid=?", size, time.Now(), rowid); err != nil {
+		return err
+	}
+	file.Size, file.Stored = size, size
+	file.Inline = false
+	file.Stripe, file.Buf = -1, nil
+	file.Chunk, file.ChunkBuf = -1, nil
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// TestSparseWrite writes past the end and extends with Truncate: the
+// stripes in between are holes that read as zeros and are not stored.
+func TestSparseWrite(t *testing.T) {
+	fs := newTestFS(t, 3)
+	w := fs.stripeWidth(fs.chunkSize)
+	_, fh := fs.Create("/img", 0, 0644)
+	fs.Write("/img", []byte("head"), 0, fh)
+	fs.Write("/img", []byte("tail"), 5*w+100, fh)
+	fs.Flush("/img", fh)
+	rowid := openHandles[fh].rowid
+	fs.Release("/img", fh)
+	want := make([]byte, 5*w+104)
+	copy(want, "head")
+	copy(want[5*w+100:], "tail")
+	if !bytes.Equal(readAll(t, fs, "/img"), want) {
+		t.Fatal("read")
+	}
+	if n := countHoles(fs, rowid); n != 4 {
+		t.Fatal("holes", n)
+	}
+	if errc, holes := fs.Getxattr("/img", holesXattr); errc != 0 || string(holes) != fmt.Sprintf("%d-%d", w, 5*w) {
+		t.Fatal("holes xattr", string(holes))
+	}
+	var st fuse.Stat_t
+	if fs.Getattr("/img", &st, ^uint64(0)) != 0 || st.Size != 5*w+104 || st.Blocks != (w+104+511)/512 {
+		t.Fatal("stat", st.Size, st.Blocks)
+	}
+	if sz := fileSize(fs.shardPath(rowid, 0)); sz > shardHeaderSize+2*(int64(fs.chunkSize)+100) {
+		t.Fatal("shard of a sparse file", sz)
+	}
+
+	if fs.Truncate("/img", 9*w, ^uint64(0)) != 0 {
+		t.Fatal("extend")
+	}
+	want = append(want, make([]byte, 9*w-int64(len(want)))...)
+	if !bytes.Equal(readAll(t, fs, "/img"), want) || countHoles(fs, rowid) != 7 {
+		t.Fatal("extended", countHoles(fs, rowid))
+	}
+
+	// a stripe written with zeros becomes a hole
+	_, fh = fs.Open("/img", fuse.O_RDWR)
+	fs.Write("/img", make([]byte, 4), 0, fh)
+	fs.Flush("/img", fh)
+	fs.Release("/img", fh)
+	copy(want, make([]byte, 4))
+	if !bytes.Equal(readAll(t, fs, "/img"), want) || countHoles(fs, rowid) != 8 {
+		t.Fatal("zero stripe", countHoles(fs, rowid))
+	}
+	var out bytes.Buffer
+	if err := fs.scrub(&out, false); err != nil {
+		t.Fatal(err, out.String())
+	}
+	fs.Unlink("/img")
+	if countHoles(fs, rowid) != 0 {
+		t.Fatal("holes of a removed file")
+	}
+}
+
+func countHoles(fs *ffs, rowid uint64) int {
+	var n int
+	fs.DB.QueryRow("select count(*) from holes where rowid=?", rowid).Scan(&n)
+	return n
+}
+
+func fileSize(filename string) int64 {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return st.Size()
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Stripe format
+//
+// Files are cut in stripes of dataShards chunks of chunkSize bytes, the chunk
+// size of a file is kept in items.chunksize (0 is the old format where every
+// part is one encrypted blob). Chunk s of stripe n is stored in a slot of the
+// shard file of s after the shard header: a 4 byte big endian length followed
+// by the encrypted chunk, see ffs_crypt.go. The top bits of the length give
+// the compression of the chunk, see ffs_compress.go. The slots table tells
+// where the slot is, files older than format 13 have it at n*slotSize, see
+// ffs_slots.go. The last
+// stripe of a file may be short, its data chunks hold only the bytes of the
+// file and its parity chunks are as long as the first data chunk. Every
+// stripe before the last one is complete. Stripes that are holes have no
+// slots, see ffs_sparse.go.
+//
+// An open file keeps only the stripe it works on in memory, so a write
+// buffer of dataShards*chunkSize bytes is all a file needs however big it is.
+
+const slotHeader = 4
+
+var errShardTruncated = errors.New("shard file is truncated")
+
+// chunkSizeFor picks the chunk size that makes one stripe fit in mb megabytes.
+func (fs *ffs) chunkSizeFor(mb int) int {
+	cs := (mb << 20) / fs.dataShards &^ 4095
+	if cs < 4096 {
+		cs = 4096
+	}
+	if cs > 64<<20 {
+		cs = 64 << 20 // the slot length has slotLenBits
+	}
+	return cs
+}
+
+// slotSize is the space one chunk of a cs chunk size file takes in a shard file.
+func slotSize(fc *fileCrypt, cs int) int64 {
+	return int64(slotHeader + cs + fc.overhead)
+}
+
+// slotOffset is the position of stripe n in a shard file.
+func slotOffset(fc *fileCrypt, cs int, n int64) int64 {
+	return shardHeaderSize + n*slotSize(fc, cs)
+}
+
+// stripeWidth is the number of file bytes in a full stripe.
+func (fs *ffs) stripeWidth(cs int) int64 {
+	return int64(fs.dataShards * cs)
+}
+
+// stripeCount is the number of stripes a file of size bytes has.
+func (fs *ffs) stripeCount(size int64, cs int) int64 {
+	w := fs.stripeWidth(cs)
+	return (size + w - 1) / w
+}
+
+// stripeLen is the number of file bytes in stripe n.
+func (fs *ffs) stripeLen(size int64, cs int, n int64) int {
+	l := size - n*fs.stripeWidth(cs)
+	if l < 0 {
+		return 0
+	}
+	if l > fs.stripeWidth(cs) {
+		return int(fs.stripeWidth(cs))
+	}
+	return int(l)
+}
+
+// chunkLen is the number of file bytes in chunk i of a stripe of l bytes.
+func chunkLen(l int, cs int, i int) int {
+	l -= i * cs
+	if l < 0 {
+		return 0
+	}
+	if l > cs {
+		return cs
+	}
+	return l
+}
+
+// chunkSizeOf returns the chunk size of rowid, 0 for the whole part format.
+func (fs *ffs) chunkSizeOf(rowid uint64) int {
+	var cs int
+	fs.DB.QueryRow("select chunksize from items where rowid=?", rowid).Scan(&cs)
+	return cs
+}
+
+// sealedChunk is a chunk as it is stored in its slot.
+type sealedChunk struct {
+	algo byte // compression
+	data []byte
+}
+
+// writeSlot stores sealed as stripe n of shard s. A dense shard file records
+// the slot in the index once the chunk is written, see ffs_slots.go.
+func (fs *ffs) writeSlot(fc *fileCrypt, s int, cs int, n int64, sealed sealedChunk) error {
+	filename := fs.shardPath(fc.rowid, s)
+	if !fc.dense() {
+		if int64(slotHeader+len(sealed.data)) > slotSize(fc, cs) {
+			return fmt.Errorf("chunk of %d bytes does not fit in a %d byte slot", len(sealed.data), slotSize(fc, cs))
+		}
+		return fs.putSlot(filename, fc, s, cs, slotOffset(fc, cs, n), sealed)
+	}
+	ref, record := fs.placeSlot(fc.rowid, s, n, int64(slotHeader+len(sealed.data)))
+	if err := fs.putSlot(filename, fc, s, cs, ref.ofst, sealed); err != nil {
+		return err
+	}
+	if record {
+		return fs.recordSlot(fc.rowid, s, n, ref)
+	}
+	return nil
+}
+
+// readSlot returns the sealed chunk stored as stripe n of shard s.
+func (fs *ffs) readSlot(fc *fileCrypt, s int, cs int, n int64) (sealedChunk, error) {
+	f, err := os.Open(fs.shardPath(fc.rowid, s))
+	if err != nil {
+		return sealedChunk{}, err
+	}
+	defer f.Close()
+	sh := make([]byte, shardHeaderSize)
+	if _, err := f.ReadAt(sh, 0); err != nil {
+		return sealedChunk{}, fmt.Errorf("%w: %s", errShardHeader, err)
+	}
+	if err := fs.checkShardHeader(sh, fc.rowid, s, cs); err != nil {
+		return sealedChunk{}, err
+	}
+	ofst, max := slotOffset(fc, cs, n), slotSize(fc, cs)
+	if fc.dense() {
+		ref, found := fs.findSlot(fc.rowid, s, n)
+		if !found {
+			return sealedChunk{}, fmt.Errorf("%w: stripe %d has no slot", errShardTruncated, n)
+		}
+		ofst, max = ref.ofst, ref.cap
+	}
+	var h [slotHeader]byte
+	if _, err := f.ReadAt(h[:], ofst); err != nil {
+		if err == io.EOF {
+			return sealedChunk{}, fmt.Errorf("%w: stripe %d is not stored", errShardTruncated, n)
+		}
+		return sealedChunk{}, err
+	}
+	v := binary.BigEndian.Uint32(h[:])
+	l := int64(v & (1<<slotLenBits - 1))
+	if l == 0 || slotHeader+l > max {
+		return sealedChunk{}, fmt.Errorf("stripe %d has a bad length %d", n, l)
+	}
+	sealed := sealedChunk{algo: byte(v >> slotLenBits), data: make([]byte, l)}
+	if _, err := f.ReadAt(sealed.data, ofst+slotHeader); err != nil {
+		if err == io.EOF {
+			return sealedChunk{}, fmt.Errorf("%w: stripe %d is cut short", errShardTruncated, n)
+		}
+		return sealedChunk{}, err
+	}
+	return sealed, nil
+}
+
+// readChunk reads and decrypts chunk s of stripe n, it must hold want bytes.
+// Older files without a file key may hold more.
+func (fs *ffs) readChunk(fc *fileCrypt, s int, cs int, n int64, want int) ([]byte, error) {
+	sealed, err := fs.readSlot(fc, s, cs, n)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := fc.open(s, n, sealed.algo, sealed.data)
+	if err != nil {
+		return nil, fmt.Errorf("%s of stripe %d: %w", fs.shardName(s), n, err)
+	}
+	if fc.aead != nil && len(chunk) != want {
+		return nil, fmt.Errorf("%s of stripe %d is %d bytes, expected %d", fs.shardName(s), n, len(chunk), want)
+	}
+	if len(chunk) < want {
+		return nil, fmt.Errorf("%s of stripe %d decrypted to %d bytes, expected %d", fs.shardName(s), n, len(chunk), want)
+	}
+	return chunk[:want], nil
+}
+
+// readStripe returns the bytes of stripe n of a file of size bytes. Chunks
+// that are missing or broken are rebuilt from the parity chunks, a hole is
+// zeros.
+func (fs *ffs) readStripe(fc *fileCrypt, size int64, cs int, n int64) ([]byte, error) {
+	rowid := fc.rowid
+	l := fs.stripeLen(size, cs, n)
+	if fs.isHole(rowid, n) {
+		return make([]byte, l), nil
+	}
+	cl := chunkLen(l, cs, 0)
+	shards := make([][]byte, fs.dataShards+fs.parityShards)
+	missing := 0
+	for i := 0; i < fs.dataShards; i++ {
+		chunk, err := fs.readChunk(fc, i, cs, n, chunkLen(l, cs, i))
+		if err != nil {
+			log.Printf(nlib.BashFontColor_RED+"%s of %s is not readable: %s"+nlib.BashFontColor_RESET, fs.shardName(i), fs.fileName(rowid), err)
+			missing++
+			continue
+		}
+		shards[i] = padTo(chunk, cl)
+	}
+	if missing > fs.parityShards {
+		return nil, errTooManyMissing
+	}
+	if missing > 0 {
+		for j := 0; j < fs.parityShards; j++ {
+			csum, err := fs.readChunk(fc, fs.dataShards+j, cs, n, cl)
+			if err != nil {
+				log.Printf(nlib.BashFontColor_RED+"%s of %s is not readable: %s"+nlib.BashFontColor_RESET, fs.shardName(fs.dataShards+j), fs.fileName(rowid), err)
+				continue
+			}
+			shards[fs.dataShards+j] = csum
+		}
+		if err := fs.erasure.reconstruct(shards); err != nil {
+			return nil, err
+		}
+		log.Printf(nlib.BashFontColor_YELLOW+"%d chunks of stripe %d of %s rebuilt from parity"+nlib.BashFontColor_RESET, missing, n, fs.fileName(rowid))
+	}
+
+	buf := make([]byte, 0, fs.stripeWidth(cs))
+	for i := 0; i < fs.dataShards; i++ {
+		buf = append(buf, shards[i][:chunkLen(l, cs, i)]...)
+	}
+	return buf, nil
+}
+
+// sealStripe encrypts the data chunks of a stripe and the parity chunks
+// computed from them, in shard order.
+func (fs *ffs) sealStripe(fc *fileCrypt, cs int, n int64, buf []byte) []sealedChunk {
+	cl := chunkLen(len(buf), cs, 0)
+	shards := make([][]byte, fs.dataShards)
+	for i := range shards {
+		shards[i] = padTo(stripe(buf, i, cs), cl)
+	}
+	parity := fs.erasure.encode(shards)
+	sealed := make([]sealedChunk, fs.dataShards+fs.parityShards)
+	for s := range sealed {
+		chunk := stripe(buf, s, cs)
+		if s >= fs.dataShards {
+			chunk = parity[s-fs.dataShards]
+		}
+		sealed[s].algo, sealed[s].data = fc.seal(s, n, chunk)
+	}
+	return sealed
+}
+
+// writeStripe encrypts stripe n, computes its parity and writes every chunk
+// in its slot. When only is not -1 just the chunks kept in that folder are
+// written, rebuild uses it.
+func (fs *ffs) writeStripe(fc *fileCrypt, cs int, n int64, buf []byte, only int) error {
+	for s, sealed := range fs.sealStripe(fc, cs, n, buf) {
+		if only != -1 && fs.shardFolder(fc.rowid, s) != only {
+			continue
+		}
+		if err := fs.writeSlot(fc, s, cs, n, sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadStripe makes stripe n the buffered stripe of an open file, the
+// buffered one is written first when it is dirty.
+func (fs *ffs) loadStripe(file *ffs_File, n int64) error {
+	if file.Stripe == n {
+		return nil
+	}
+	if file.Inline && file.Stripe == 0 {
+		file.Dirty = true // stripe 0 is only in items.inline
+	}
+	if err := fs.flushStripe(file); err != nil {
+		return err
+	}
+	file.Buf = make([]byte, 0, fs.stripeWidth(file.ChunkSize))
+	file.Stripe = -1
+	if n < fs.stripeCount(file.Stored, file.ChunkSize) {
+		buf, err := fs.readStripe(file.Crypt, file.Stored, file.ChunkSize, n)
+		if err != nil {
+			return err
+		}
+		file.Buf = buf
+	}
+	file.Stripe = n
+	return nil
+}
+
+// flushStripe writes the buffered stripe of an open file when it is dirty.
+// A write past the end of the stored file completes the old last stripe and
+// leaves the stripes in between as holes first.
+func (fs *ffs) flushStripe(file *ffs_File) error {
+	if !file.Dirty {
+		return nil
+	}
+	rowid := uint64(file.ID)
+	cs := file.ChunkSize
+	w := fs.stripeWidth(cs)
+	fs.createFileName(rowid)
+	stored := fs.stripeCount(file.Stored, cs)
+	if stored > 0 && stored-1 < file.Stripe && file.Stored%w != 0 && !fs.isHole(rowid, stored-1) {
+		buf, err := fs.readStripe(file.Crypt, file.Stored, cs, stored-1)
+		if err != nil {
+			return err
+		}
+		if err := fs.putStripe(file.Crypt, cs, stored-1, padTo(buf, int(w))); err != nil {
+			return err
+		}
+	}
+	for n := stored; n < file.Stripe; n++ {
+		if err := fs.setHole(rowid, n, true); err != nil {
+			return err
+		}
+	}
+	if err := fs.putStripe(file.Crypt, cs, file.Stripe, file.Buf); err != nil {
+		return err
+	}
+	if end := file.Stripe*w + int64(len(file.Buf)); end > file.Stored {
+		file.Stored = end
+	}
+	file.Dirty = false
+	file.Changed = true
+	file.Chunk = -1
+	return nil
+}
+
+// writeAt copies buff into an open file at ofst one stripe at a time.
+func (fs *ffs) writeAt(file *ffs_File, buff []byte, ofst int64) error {
+	w := fs.stripeWidth(file.ChunkSize)
+	for len(buff) > 0 {
+		n := ofst / w
+		if err := fs.loadStripe(file, n); err != nil {
+			return err
+		}
+		o := int(ofst - n*w)
+		end := o + len(buff)
+		if end > int(w) {
+			end = int(w)
+		}
+		if end > len(file.Buf) {
+			file.Buf = append(file.Buf, make([]byte, end-len(file.Buf))...)
+		}
+		c := copy(file.Buf[o:end], buff)
+		file.Dirty = true
+		buff = buff[c:]
+		ofst += int64(c)
+		if ofst > file.Size {
+			file.Size = ofst
+		}
+	}
+	return nil
+}
+
+// shrinkFile cuts an open file to size bytes. Only the new last stripe is
+// encoded again with its parity, the slots after it are cut off the shard
+// files.
+func (fs *ffs) shrinkFile(file *ffs_File, size int64) error {
+	if file.Inline {
+		file.Buf = padTo(file.Buf, int(size))[:size]
+		file.Size = size
+		if fs.inlines(file) {
+			return fs.inlineFile(file)
+		}
+		file.Dirty = true
+	}
+	if err := fs.flushStripe(file); err != nil {
+		return err
+	}
+	rowid := uint64(file.ID)
+	cs := file.ChunkSize
+	n := fs.stripeCount(size, cs)
+	if size == 0 {
+		fs.truncateFile(rowid)
+	} else {
+		last := n - 1
+		if size%fs.stripeWidth(cs) != 0 && last < fs.stripeCount(file.Stored, cs) && !fs.isHole(rowid, last) {
+			buf, err := fs.readStripe(file.Crypt, file.Stored, cs, last)
+			if err != nil {
+				return err
+			}
+			if err := fs.putStripe(file.Crypt, cs, last, buf[:fs.stripeLen(size, cs, last)]); err != nil {
+				return err
+			}
+		}
+		if _, err := fs.DB.Exec("delete from holes where rowid=? and stripe>=?", rowid, n); err != nil {
+			return err
+		}
+		if file.Crypt.dense() {
+			if err := fs.dropSlots(rowid, n, math.MaxInt64); err != nil {
+				return err
+			}
+		} else {
+			end := slotOffset(file.Crypt, cs, n)
+			for s := 0; s < fs.dataShards+fs.parityShards; s++ {
+				if st, err := os.Stat(fs.shardPath(rowid, s)); err == nil && st.Size() > end {
+					if err := os.Truncate(fs.shardPath(rowid, s), end); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	if _, err := fs.DB.Exec("update items set fsize=?,mdate=?,inline=null where rowid=?", size, time.Now(), rowid); err != nil {
+		return err
+	}
+	file.Size, file.Stored = size, size
+	file.Inline = false
+	file.Stripe, file.Buf = -1, nil
+	file.Chunk, file.ChunkBuf = -1, nil
+	if fs.inlines(file) {
+		return fs.inlineFile(file)
+	}
+	return nil
+}
+
+// chunkAt returns chunk i of stripe n of an open file as it is stored. Only
+// that chunk is read and decrypted, the rest of the stripe is only needed
+// when the chunk has to be rebuilt from parity.
+func (fs *ffs) chunkAt(file *ffs_File, n int64, i int) ([]byte, error) {
+	g := n*int64(fs.dataShards) + int64(i)
+	if file.Chunk == g {
+		return file.ChunkBuf, nil
+	}
+	rowid := uint64(file.ID)
+	cs := file.ChunkSize
+	want := chunkLen(fs.stripeLen(file.Stored, cs, n), cs, i)
+	if fs.isHole(rowid, n) {
+		file.Chunk = g
+		file.ChunkBuf = make([]byte, want)
+		return file.ChunkBuf, nil
+	}
+	chunk, err := fs.readChunk(file.Crypt, i, cs, n, want)
+	if err != nil {
+		log.Printf(nlib.BashFontColor_RED+"%s of %s is not readable: %s"+nlib.BashFontColor_RESET, fs.shardName(i), fs.fileName(rowid), err)
+		buf, err := fs.readStripe(file.Crypt, file.Stored, cs, n)
+		if err != nil {
+			return nil, err
+		}
+		chunk = stripe(buf, i, cs)
+	}
+	file.Chunk = g
+	file.ChunkBuf = chunk
+	return chunk, nil
+}
+
+// readAt fills buff from an open file at ofst and returns the number of
+// bytes read. The buffered stripe is used when the range is in it, otherwise
+// only the chunks the range covers are fetched. Bytes after the stored end of
+// the file that are not in the buffer are zeros.
+func (fs *ffs) readAt(file *ffs_File, buff []byte, ofst int64) (int, error) {
+	w := fs.stripeWidth(file.ChunkSize)
+	cs := int64(file.ChunkSize)
+	done := 0
+	for done < len(buff) && ofst < file.Size {
+		n := ofst / w
+		var start, end int64
+		var data []byte
+		if n == file.Stripe {
+			start, end, data = n*w, (n+1)*w, file.Buf
+		} else {
+			i := (ofst - n*w) / cs
+			start = n*w + i*cs
+			end = start + cs
+			if start < file.Stored {
+				chunk, err := fs.chunkAt(file, n, int(i))
+				if err != nil {
+					return done, err
+				}
+				data = chunk
+			}
+		}
+		if end > file.Size {
+			end = file.Size
+		}
+		c := int(end - ofst)
+		if c > len(buff)-done {
+			c = len(buff) - done
+		}
+		part := buff[done : done+c]
+		copied := 0
+		if o := int(ofst - start); o < len(data) {
+			copied = copy(part, data[o:])
+		}
+		for x := copied; x < c; x++ {
+			part[x] = 0
+		}
+		done += c
+		ofst += int64(c)
+	}
+	return done, nil
+}
+
+// stripeWriter writes a new file of the stripe format from front to back,
+// it keeps one stripe in memory.
+type stripeWriter struct {
+	fs   *ffs
+	fc   *fileCrypt
+	cs   int
+	n    int64 // stripe in buf
+	buf  []byte
+	size int64 // bytes written so far
+}
+
+func (fs *ffs) newStripeWriter(fc *fileCrypt, cs int) *stripeWriter {
+	fs.createFileName(fc.rowid)
+	fs.truncateFile(fc.rowid)
+	return &stripeWriter{fs: fs, fc: fc, cs: cs}
+}
+
+func (w *stripeWriter) write(b []byte) error {
+	sw := int(w.fs.stripeWidth(w.cs))
+	w.size += int64(len(b))
+	for len(b) > 0 {
+		c := sw - len(w.buf)
+		if c > len(b) {
+			c = len(b)
+		}
+		w.buf = append(w.buf, b[:c]...)
+		b = b[c:]
+		if len(w.buf) == sw {
+			if err := w.fs.putStripe(w.fc, w.cs, w.n, w.buf); err != nil {
+				return err
+			}
+			w.buf = w.buf[:0]
+			w.n++
+		}
+	}
+	return nil
+}
+
+// close writes the short last stripe.
+func (w *stripeWriter) close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.fs.putStripe(w.fc, w.cs, w.n, w.buf)
+}
+
+// convertFile moves a file of the whole part format to stripes with a file
+// key of its own before it is written. Those files can only be read in full,
+// so this needs their size in memory once. The stripes go to new shard files
+// that replace the parts once items.chunksize says the file has stripes, see
+// ffs_swap.go.
+func (fs *ffs) convertFile(file *ffs_File) error {
+	rowid := uint64(file.ID)
+	var data []byte
+	if file.Stored > 0 {
+		var err error
+		if data, err = fs.readData(rowid, file.Crypt.keys, file.Stored); err != nil {
+			return err
+		}
+	}
+	fc, err := fs.newFileCrypt(rowid, file.Crypt.keys)
+	if err != nil {
+		return err
+	}
+	fc.compress = file.Crypt.compress
+	cs := fs.chunkSize
+	w := fs.stripeWidth(cs)
+	a := fs.newSlotAppender(fc, cs)
+	for n := int64(0); n*w < int64(len(data)); n++ {
+		if err := a.writeStripe(n, stripe(data, int(n), int(w))); err != nil {
+			fs.removeSwapShards(rowid)
+			return err
+		}
+	}
+	err = fs.commitSwap(rowid, cs, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("update items set chunksize=?,sumenc=1,filekey=?,format=? where rowid=?", cs, fc.wrapped, fc.format, rowid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("delete from holes where rowid=?", rowid); err != nil {
+			return err
+		}
+		return a.commit(tx)
+	})
+	if err != nil {
+		return err
+	}
+	file.Crypt = fc
+	file.ChunkSize = cs
+	file.Data = nil
+	file.Loaded = false
+	file.Stripe = -1
+	file.Chunk = -1
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestShardTruncated cuts shard files short: with one short shard the file is
+// read from parity and scrub reports it, with more the read fails.
+func TestShardTruncated(t *testing.T) {
+	fs := newTestFS(t, 3)
+	w := fs.stripeWidth(fs.chunkSize)
+	data := make([]byte, 3*w)
+	rand.Read(data)
+	rowid := writeFile(t, fs, "/a", data)
+
+	if err := os.Truncate(fs.shardPath(rowid, 0), shardHeaderSize+10); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, fs, "/a"); !bytes.Equal(got, data) {
+		t.Fatal("read with a truncated shard")
+	}
+	var out bytes.Buffer
+	if err := fs.scrub(&out, false); err == nil || !strings.Contains(out.String(), "truncated") {
+		t.Fatal("scrub", err, out.String())
+	}
+
+	if err := os.Truncate(fs.shardPath(rowid, 1), shardHeaderSize+10); err != nil {
+		t.Fatal(err)
+	}
+	errc, fh := fs.Open("/a", 0)
+	if errc != 0 {
+		t.Fatal("open", errc)
+	}
+	defer fs.Release("/a", fh)
+	if n := fs.Read("/a", make([]byte, 4096), 2*w, fh); n >= 0 {
+		t.Fatal("read with two truncated shards", n)
+	}
+}
+
+// TestTruncate shrinks and extends a file: the bytes up to the new size stay,
+// the bytes after the old size read as zeros and the parity stays right.
+func TestTruncate(t *testing.T) {
+	fs := newTestFS(t, 3)
+	w := fs.stripeWidth(fs.chunkSize)
+	data := make([]byte, 4*w+123)
+	rand.Read(data)
+	rowid := writeFile(t, fs, "/a", data)
+	for _, size := range []int64{3*w + 7, 3 * w, 2*w + 1, 4 * w, 5, 0, w + 3} {
+		if errc := fs.Truncate("/a", size, ^uint64(0)); errc != 0 {
+			t.Fatalf("truncate to %d: %d", size, errc)
+		}
+		if size <= int64(len(data)) {
+			data = data[:size]
+		} else {
+			data = append(data, make([]byte, size-int64(len(data)))...)
+		}
+		if got := readAll(t, fs, "/a"); !bytes.Equal(got, data) {
+			t.Fatalf("truncate to %d: read %d bytes", size, len(got))
+		}
+		var out bytes.Buffer
+		if err := fs.scrub(&out, false); err != nil {
+			t.Fatalf("truncate to %d: %s %s", size, err, out.String())
+		}
+	}
+	if sz := fileSize(fs.shardPath(rowid, 0)); sz > shardHeaderSize+2*int64(fs.chunkSize) {
+		t.Fatal("shard after truncate", sz)
+	}
+
+	// an open file keeps its handle and goes on from the new size
+	errc, fh := fs.Open("/a", 2)
+	if errc != 0 {
+		t.Fatal("open", errc)
+	}
+	fs.Write("/a", []byte("more"), w+100, fh)
+	if errc := fs.Truncate("/a", w+50, fh); errc != 0 {
+		t.Fatal("truncate open file", errc)
+	}
+	fs.Write("/a", []byte("end"), w+50, fh)
+	fs.Flush("/a", fh)
+	fs.Release("/a", fh)
+	data = append(data[:w+3], make([]byte, 47)...)
+	data = append(data, "end"...)
+	if got := readAll(t, fs, "/a"); !bytes.Equal(got, data) {
+		t.Fatal("truncate open file read", len(got))
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Volume format
+//
+// Every source and checksum folder holds a copy of the superblock in
+// .ffs_volume, a JSON document with the layout of the volume and the index
+// of the folder in it. ffs refuses to use a folder whose superblock belongs
+// to another volume or to another position, and a volume written by a newer
+// format version.
+//
+// Format versions:
+//
+//	1  parts are single nlib.Encrypt blobs, stripe files have no header
+//	2  superblock, every stripe shard file starts with a shard header
+//	3  random volume keys wrapped in the key header of the superblock
+//	4  key slots and a key ring sealed with the master key
+//	5  AES-256-GCM chunks under per-file keys, see ffs_crypt.go
+//	6  stripe index in the chunk associated data, items.format, see ffs_crypt.go
+//	7  compressed chunks, the algorithm is in the slot length
+//	8  files stored in content defined chunks shared between files, see ffs_dedup.go
+//	9  small files packed together, see ffs_pack.go
+//	10 tiny files inline in the metadata database, see ffs_inline.go
+//	11 stripes of zeros are holes that are not stored, see ffs_sparse.go
+//	12 metadata replicas sealed with AES-256-GCM, see ffs_meta.go
+//	13 dense shard files with a slot index, see ffs_slots.go
+//
+// The shard header is shardHeaderSize bytes, integers are big endian:
+//
+//	0   4  magic "FFSS"
+//	4   2  format version it was written with
+//	6   2  shard index, data shards first
+//	8   8  rowid of the file
+//	16  4  chunk size
+//	20  16 volume id
+//	36  28 zero
+//
+// The slots of the stripes follow the header, see ffs_stripe.go.
+
+const (
+	formatVersion   = 13
+	superblockFile  = ".ffs_volume"
+	shardMagic      = "FFSS"
+	shardHeaderSize = 64
+	cipherName      = "aes-256-gcm"
+	parityScheme    = "reed-solomon-cauchy-gf256"
+)
+
+var errShardHeader = errors.New("bad shard header")
+
+// superblock describes the volume a folder belongs to.
+type superblock struct {
+	UUID          string     `json:"uuid"`
+	FormatVersion int        `json:"format_version"`
+	Layout        string     `json:"layout"`
+	DataShards    int        `json:"data_shards"`
+	ParityShards  int        `json:"parity_shards"`
+	ParityFolders int        `json:"parity_folders"`
+	StripeWidth   int        `json:"stripe_width"` // shards in a stripe
+	ChunkSize     int        `json:"chunk_size"`   // chunk size of new files
+	Cipher        string     `json:"cipher"`
+	ParityScheme  string     `json:"parity_scheme"`
+	Folder        int        `json:"folder"` // index of this folder, checksum folders follow the sources
+	Keys          *keyHeader `json:"keys,omitempty"`
+}
+
+// newVolumeID returns a random (version 4) UUID.
+func newVolumeID() string {
+	b := make([]byte, 16)
+	readRandom(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// volumeIDBytes is the volume id as it is stored in the shard headers.
+func (fs *ffs) volumeIDBytes() []byte {
+	b, _ := hex.DecodeString(strings.Replace(fs.volumeID, "-", "", -1))
+	return padTo(b, 16)
+}
+
+// superblock returns the superblock of folder index.
+func (fs *ffs) superblock(index int) superblock {
+	layout := "dedicated"
+	if fs.rotating {
+		layout = "rotating"
+	}
+	return superblock{
+		UUID:          fs.volumeID,
+		FormatVersion: formatVersion,
+		Layout:        layout,
+		DataShards:    fs.dataShards,
+		ParityShards:  fs.parityShards,
+		ParityFolders: len(fs.csFolders),
+		StripeWidth:   fs.dataShards + fs.parityShards,
+		ChunkSize:     fs.chunkSize,
+		Cipher:        cipherName,
+		ParityScheme:  parityScheme,
+		Folder:        index,
+		Keys:          fs.keys,
+	}
+}
+
+// writeSuperblock stores the superblock of folder index in it.
+func (fs *ffs) writeSuperblock(index int) error {
+	if fs.keys != nil && fs.master != nil && !fs.keys.verify(fs.master) {
+		fs.keys.sign(fs.master)
+	}
+	b, _ := json.MarshalIndent(fs.superblock(index), "", "  ")
+	folder := fs.providers()[index]
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(folder, superblockFile), append(b, '\n'))
+}
+
+// checkSuperblocks verifies that every folder belongs to this volume at the
+// position it is given in. Folders that can not be read are left to the
+// parity, skip is the folder a rebuild replaces. A superblock of an older
+// format version or with an older key header is written again.
+func (fs *ffs) checkSuperblocks(skip int) error {
+	for index, folder := range fs.providers() {
+		if index == skip {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(folder, superblockFile))
+		if err != nil {
+			if _, serr := os.Stat(folder); serr != nil {
+				log.Printf(nlib.BashFontColor_RED+"%s is not available, the volume is degraded: %s"+nlib.BashFontColor_RESET, folder, serr)
+				continue
+			}
+			return fmt.Errorf("%s has no superblock, a new folder has to be filled with rebuild: %s", folder, err)
+		}
+		var sb superblock
+		if err := json.Unmarshal(b, &sb); err != nil {
+			return fmt.Errorf("superblock of %s is broken: %s", folder, err)
+		}
+		if sb.UUID != fs.volumeID {
+			return fmt.Errorf("%s belongs to volume %s, not %s", folder, sb.UUID, fs.volumeID)
+		}
+		if sb.FormatVersion > formatVersion {
+			return fmt.Errorf("%s has format version %d, this ffs knows up to %d", folder, sb.FormatVersion, formatVersion)
+		}
+		if sb.Folder != index {
+			return fmt.Errorf("%s is folder %d of the volume, it is given as %d", folder, sb.Folder, index)
+		}
+		keys := sb.Keys
+		sb.Keys = fs.keys
+		stale := sb.FormatVersion < formatVersion
+		if stale {
+			// written before the last upgrade, while the folder was away
+			sb.FormatVersion, sb.Cipher = formatVersion, cipherName
+		}
+		if want := fs.superblock(index); sb != want {
+			return fmt.Errorf("superblock of %s does not match the volume: %+v", folder, sb)
+		}
+		if stale || keys == nil || keys.Generation != fs.keys.Generation || !keys.verify(fs.master) {
+			log.Printf(nlib.BashFontColor_YELLOW+"Updating the superblock of %s \n"+nlib.BashFontColor_RESET, folder)
+			if err := fs.writeSuperblock(index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shardHeader returns the header of shard s of file rowid.
+func (fs *ffs) shardHeader(rowid uint64, s int, cs int) []byte {
+	h := make([]byte, shardHeaderSize)
+	copy(h, shardMagic)
+	binary.BigEndian.PutUint16(h[4:], formatVersion)
+	binary.BigEndian.PutUint16(h[6:], uint16(s))
+	binary.BigEndian.PutUint64(h[8:], rowid)
+	binary.BigEndian.PutUint32(h[16:], uint32(cs))
+	copy(h[20:36], fs.volumeIDBytes())
+	return h
+}
+
+// checkShardHeader compares the header read from a shard file with the one
+// it should have. Shards written by older format versions from 2 on are fine.
+func (fs *ffs) checkShardHeader(h []byte, rowid uint64, s int, cs int) error {
+	want := fs.shardHeader(rowid, s, cs)
+	if v := binary.BigEndian.Uint16(h[4:]); v >= 2 && v <= formatVersion {
+		copy(want[4:6], h[4:6])
+	}
+	if !bytes.Equal(h, want) {
+		if string(h[:4]) != shardMagic {
+			return fmt.Errorf("%w: no magic", errShardHeader)
+		}
+		return fmt.Errorf("%w: version %d shard %d rowid %d chunk size %d, expected shard %d of %d with chunk size %d", errShardHeader,
+			binary.BigEndian.Uint16(h[4:]), binary.BigEndian.Uint16(h[6:]), binary.BigEndian.Uint64(h[8:]), binary.BigEndian.Uint32(h[16:]), s, rowid, cs)
+	}
+	return nil
+}
+
+// upgradeShardHeaders puts a header in front of the shard files of stripe
+// files written by format version 1. Files that already have one are left
+// alone, so an interrupted upgrade can run again.
+func (fs *ffs) upgradeShardHeaders() error {
+	files, err := fs.listFiles(0)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.chunkSize == 0 {
+			continue
+		}
+		for s := 0; s < fs.dataShards+fs.parityShards; s++ {
+			if err := fs.addShardHeader(f.rowid, s, f.chunkSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *ffs) addShardHeader(rowid uint64, s int, cs int) error {
+	filename := fs.shardPath(rowid, s)
+	in, err := os.Open(filename)
+	if err != nil {
+		log.Printf(nlib.BashFontColor_RED+"%s can not be upgraded, it is left to the parity: %s"+nlib.BashFontColor_RESET, filename, err)
+		return nil
+	}
+	defer in.Close()
+	magic := make([]byte, len(shardMagic))
+	if _, err := in.ReadAt(magic, 0); err == nil && string(magic) == shardMagic {
+		return nil
+	}
+	tmp := filename + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(fs.shardHeader(rowid, s, cs))
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// Shard swaps
+//
+// Rekey and the conversion of whole part files write a file again into new
+// shard files next to the old ones. The new shards replace the old ones in
+// two steps: the database row of the file is updated together with a row in
+// swaps in one transaction, then the new shards are renamed over the old ones
+// and the swaps row is removed. A crash before the commit leaves the old file
+// as it was and new shards that the next attempt writes again, a crash after
+// it leaves a swaps row that finishSwaps completes at the next start. Every
+// new shard is there before the commit, one without slots as a bare header,
+// so a new shard that is missing later was renamed already.
+
+const swapSuffix = ".new"
+
+// swapPath returns the name shard s of file rowid is written to before the swap.
+func (fs *ffs) swapPath(rowid uint64, s int) string {
+	return fs.shardPath(rowid, s) + swapSuffix
+}
+
+// removeSwapShards removes the new shards of rowid that were not swapped in.
+func (fs *ffs) removeSwapShards(rowid uint64) {
+	for s := 0; s < fs.dataShards+fs.parityShards; s++ {
+		os.Remove(fs.swapPath(rowid, s))
+	}
+}
+
+// commitSwap writes the missing new shards of rowid as bare headers, runs
+// update and records the swap in one transaction and swaps the shards.
+func (fs *ffs) commitSwap(rowid uint64, cs int, update func(tx *sql.Tx) error) error {
+	for s := 0; s < fs.dataShards+fs.parityShards; s++ {
+		filename := fs.swapPath(rowid, s)
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			if err := writeFileAtomic(filename, fs.shardHeader(rowid, s, cs)); err != nil {
+				return err
+			}
+		}
+	}
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := update(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE into swaps(rowid) VALUES (?)", rowid); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return fs.finishSwap(rowid)
+}
+
+// finishSwap renames the new shards of rowid that are still there over the
+// old ones. A shard without slots is not kept.
+func (fs *ffs) finishSwap(rowid uint64) error {
+	for s := 0; s < fs.dataShards+fs.parityShards; s++ {
+		filename := fs.shardPath(rowid, s)
+		if err := os.Rename(fs.swapPath(rowid, s), filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if st, err := os.Stat(filename); err == nil && st.Size() <= shardHeaderSize {
+			os.Remove(filename)
+		}
+	}
+	_, err := fs.DB.Exec("delete from swaps where rowid=?", rowid)
+	return err
+}
+
+// finishSwaps completes the swaps an interrupted rekey or conversion
+// committed.
+func (fs *ffs) finishSwaps() error {
+	rows, err := fs.DB.Query("select rowid from swaps")
+	if err != nil {
+		return err
+	}
+	var pending []uint64
+	for rows.Next() {
+		var rowid uint64
+		rows.Scan(&rowid)
+		pending = append(pending, rowid)
+	}
+	rows.Close()
+	for _, rowid := range pending {
+		log.Printf(nlib.BashFontColor_YELLOW+"Finishing the interrupted shard swap of item %d \n"+nlib.BashFontColor_RESET, rowid)
+		if err := fs.finishSwap(rowid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
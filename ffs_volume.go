@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/nuveusltd/nlib"
+)
+
+// addColumn adds a column to a table of a database created by an older version.
+func (fs *ffs) addColumn(table string, column string, decl string) error {
+	rows, err := fs.DB.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		if name == column {
+			return nil
+		}
+	}
+	_, err = fs.DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
+// getSetting reads a volume setting, def is returned when it is not set.
+func (fs *ffs) getSetting(name string, def string) string {
+	value := def
+	fs.DB.QueryRow("select value from settings where name=?", name).Scan(&value)
+	return value
+}
+
+func (fs *ffs) setSetting(name string, value string) error {
+	_, err := fs.DB.Exec("INSERT OR REPLACE into settings(name,value) VALUES (?,?)", name, value)
+	return err
+}
+
+func (fs *ffs) getIntSetting(name string, def int) int {
+	value, err := strconv.Atoi(fs.getSetting(name, strconv.Itoa(def)))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// setupVolume loads the shard layout of the volume. The layout is fixed when
+// the volume is created: layout, parityShards (0 is one shard per checksum
+// folder, or one shard for the rotating layout) and writeBuffer (megabytes of
+// a stripe) are only used then. Volumes created before the layout was stored
+// have a single XOR parity shard.
+//
+// The dedicated layout keeps the data shards in the sources and the parity
+// shards in the checksum folders. The rotating layout has no checksum
+// folders, every file puts its k data and m parity shards on the sources
+// starting from a different one, like RAID5.
+func (fs *ffs) setupVolume(created bool, layout string, parityShards int, writeBuffer int) error {
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS settings (name TEXT, value TEXT, UNIQUE(name))")
+	if err := fs.addColumn("items", "sumenc", "integer default 0"); err != nil {
+		return err
+	}
+	if err := fs.addColumn("items", "chunksize", "integer default 0"); err != nil {
+		return err
+	}
+	if err := fs.addColumn("items", "keygen", "integer default 0"); err != nil {
+		return err
+	}
+	if err := fs.addColumn("items", "filekey", "blob"); err != nil {
+		return err
+	}
+	if err := fs.addColumn("items", "deduped", "integer default 0"); err != nil {
+		return err
+	}
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS chunks (hash BLOB, keygen integer, object integer, size integer, refs integer, UNIQUE(hash))")
+	fs.DB.Exec("CREATE INDEX IF NOT EXISTS ix_chunks_object ON chunks(object)")
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS manifests (rowid integer, ofst integer, object integer, UNIQUE(rowid,ofst))")
+	fs.DB.Exec("CREATE INDEX IF NOT EXISTS ix_manifests_object ON manifests(object)")
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS dedups (rowid integer, UNIQUE(rowid))")
+	if err := fs.addColumn("items", "packed", "integer default 0"); err != nil {
+		return err
+	}
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS packed (rowid integer, pack integer, ofst integer, size integer, UNIQUE(rowid))")
+	fs.DB.Exec("CREATE INDEX IF NOT EXISTS ix_packed_pack ON packed(pack)")
+	if err := fs.addColumn("items", "inline", "blob"); err != nil {
+		return err
+	}
+	if err := fs.addColumn("items", "format", "integer default 0"); err != nil {
+		return err
+	}
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS holes (rowid integer, stripe integer, UNIQUE(rowid,stripe))")
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS swaps (rowid integer, UNIQUE(rowid))")
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS slots (rowid integer, shard integer, stripe integer, ofst integer, cap integer, UNIQUE(rowid,shard,stripe))")
+
+	if fs.getSetting("data_shards", "") == "" {
+		dataShards := len(fs.folders)
+		if !created {
+			layout = "dedicated"
+			parityShards = 1
+		} else if layout == "rotating" {
+			if parityShards == 0 {
+				parityShards = 1
+			}
+			dataShards = len(fs.folders) - parityShards
+		} else if parityShards == 0 {
+			parityShards = len(fs.csFolders)
+		}
+		fs.setSetting("layout", layout)
+		fs.setSetting("data_shards", strconv.Itoa(dataShards))
+		fs.setSetting("parity_shards", strconv.Itoa(parityShards))
+		fs.setSetting("parity_folders", strconv.Itoa(len(fs.csFolders)))
+	}
+
+	layout = fs.getSetting("layout", "dedicated")
+	k := fs.getIntSetting("data_shards", len(fs.folders))
+	m := fs.getIntSetting("parity_shards", 1)
+	pf := fs.getIntSetting("parity_folders", 1)
+	switch layout {
+	case "dedicated":
+		if k != len(fs.folders) {
+			return fmt.Errorf("volume has %d sources, %d given", k, len(fs.folders))
+		}
+		if pf != len(fs.csFolders) {
+			return fmt.Errorf("volume has %d checksum folders, %d given", pf, len(fs.csFolders))
+		}
+		if pf < 1 {
+			return fmt.Errorf("you must enter checksumdir")
+		}
+		if m < len(fs.csFolders) {
+			return fmt.Errorf("volume has %d parity shards, it can not use %d checksum folders", m, len(fs.csFolders))
+		}
+	case "rotating":
+		if len(fs.csFolders) > 0 {
+			return fmt.Errorf("rotating layout keeps parity in the sources, checksumdir can not be used")
+		}
+		if k+m != len(fs.folders) {
+			return fmt.Errorf("volume has %d sources, %d given", k+m, len(fs.folders))
+		}
+		fs.rotating = true
+	default:
+		return fmt.Errorf("unknown layout %s", layout)
+	}
+	if k < 1 || m < 1 {
+		return fmt.Errorf("volume needs at least one data and one parity shard, it has %d+%d", k, m)
+	}
+	if k+m > 256 {
+		return fmt.Errorf("%d data and %d parity shards are more than 256 shards", k, m)
+	}
+	if parityShards != 0 && parityShards != m {
+		log.Printf("--parity-shards is ignored, volume has %d parity shards \n", m)
+	}
+	fs.dataShards = k
+	fs.parityShards = m
+	fs.erasure = newErasure(k, m)
+	log.Printf("Volume layout %s %d data + %d parity shards \n", layout, k, m)
+
+	if fs.getSetting("chunk_size", "") == "" {
+		fs.setSetting("chunk_size", strconv.Itoa(fs.chunkSizeFor(writeBuffer)))
+	}
+	fs.chunkSize = fs.getIntSetting("chunk_size", fs.chunkSizeFor(writeBuffer))
+	fs.sealOverhead = len(nlib.Encrypt([]byte{0}, fs.currentKeys().data)) - 1
+	if fs.legacyUnlock {
+		if err := fs.checkLegacyKeys(); err != nil {
+			return err
+		}
+		fs.legacyUnlock = false
+	}
+	log.Printf("Write buffer %d KB, chunk size %d KB \n", fs.dataShards*fs.chunkSize>>10, fs.chunkSize>>10)
+	fs.compress, _ = compressionByName(fs.getSetting("compress", "none"))
+	fs.dedup = fs.getSetting("dedup", "off") == "on"
+	if created && fs.getSetting("pack_threshold", "") == "" {
+		fs.setSetting("pack_threshold", strconv.Itoa(64<<10))
+	}
+	fs.packThreshold = int64(fs.getIntSetting("pack_threshold", 0))
+	if created && fs.getSetting("inline_threshold", "") == "" {
+		fs.setSetting("inline_threshold", "2048")
+	}
+	fs.inlineThreshold = int64(fs.getIntSetting("inline_threshold", 0))
+	if err := fs.finishSwaps(); err != nil {
+		return err
+	}
+
+	// openDb named the cache database after fs.volumeID, a new volume keeps it
+	fresh := fs.getSetting("uuid", "") == ""
+	if fresh {
+		if fs.volumeID == "" {
+			fs.volumeID = newVolumeID()
+		}
+		fs.setSetting("uuid", fs.volumeID)
+	}
+	fs.volumeID = fs.getSetting("uuid", fs.volumeID)
+	if err := fs.checkKeyGeneration(); err != nil {
+		return err
+	}
+	rewrite := fresh || fs.keysChanged
+	if version := fs.getIntSetting("format_version", 1); version < formatVersion {
+		log.Printf("Upgrading volume from format %d to %d \n", version, formatVersion)
+		if version < 2 {
+			if err := fs.upgradeShardHeaders(); err != nil {
+				return err
+			}
+		}
+		// files with a file key were sealed with the format the volume had
+		if _, err := fs.DB.Exec("update items set format=? where filekey is not null and format=0", version); err != nil {
+			return err
+		}
+		rewrite = true
+	}
+	if rewrite {
+		if err := fs.writeSuperblocks(created); err != nil {
+			return err
+		}
+	}
+	fs.setSetting("format_version", strconv.Itoa(formatVersion))
+	fs.setSetting("key_generation", strconv.Itoa(fs.keys.Generation))
+	return nil
+}
+
+// setCompression makes name the compression of the volume.
+func (fs *ffs) setCompression(name string) error {
+	algo, err := compressionByName(name)
+	if err != nil {
+		return err
+	}
+	fs.compress = algo
+	log.Printf("Compression %s \n", compressionNames[algo])
+	return fs.setSetting("compress", compressionNames[algo])
+}
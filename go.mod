@@ -4,8 +4,11 @@ go 1.15
 
 require (
 	github.com/billziss-gh/cgofuse v1.5.0
+	github.com/klauspost/compress v1.13.1
 	github.com/mattn/go-sqlite3 v1.14.7
 	github.com/nuveusltd/nlib v0.0.0-00010101000000-000000000000
+	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
 
 replace github.com/nuveusltd/nlib => ../nlib
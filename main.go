@@ -2,10 +2,8 @@ package main
 
 import (
 	"database/sql"
-	"encoding/binary"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
 	"os"
@@ -13,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -28,32 +27,82 @@ const (
 var (
 	BuildNumber string
 	Version     string
-	enckey      []byte
 	openFiles   map[string]ffs_File
+	openHandles = map[uint64]openHandle{} // open handles by fh
+	lastHandle  uint64
 )
 
 type ffs struct {
 	fuse.FileSystemBase
-	DB       *sql.DB
-	folders  []string
-	csFolder string
-	uid      uint32
-	gid      uint32
+	DB              *sql.DB
+	folders         []string
+	csFolders       []string
+	dataShards      int
+	parityShards    int
+	rotating        bool
+	chunkSize       int   // chunk size of new files
+	compress        byte  // compression of files without a user.ffs.compress xattr
+	dedup           bool  // written files are stored in content defined chunks
+	packThreshold   int64 // files up to this size are packed, 0 for none
+	inlineThreshold int64 // files up to this size are kept in the database, 0 for none
+	sealOverhead    int   // bytes nlib.Encrypt adds to a chunk
+	erasure         *erasure
+	volumeID        string
+	master          []byte  // master key, seals the key ring
+	ring            keyRing // key sets, the newest first
+	keys            *keyHeader
+	slot            int  // key slot the volume is unlocked with
+	keysChanged     bool // keys is not in the superblocks yet
+	legacyUnlock    bool // keys were derived from the password, checkLegacyKeys has to confirm them
+	dbFile          string
+	cacheDir        string        // local folder of the database
+	legacyDb        string        // plain database in the first source, removed after the first sync
+	metaSum         [32]byte      // hash of the database at the last replica sync
+	metaInterval    time.Duration // how often the replicas are synced while mounted
+	rekeying        uint64        // file the rekey works on
+	rekeyTouched    bool          // the file of rekeying was opened or changed meanwhile
+	deduping        uint64        // file the dedup worker works on
+	dedupTouched    bool          // the file of deduping was opened or changed meanwhile
+	uid             uint32
+	gid             uint32
+	lock            sync.Mutex
+}
+
+// synchronize serializes the calls that use openFiles, defer fs.synchronize()()
+func (fs *ffs) synchronize() func() {
+	fs.lock.Lock()
+	return func() {
+		fs.lock.Unlock()
+	}
 }
 
 func usage() {
 	fmt.Println("ffs FileSytem " + Version + "." + BuildNumber)
+	fmt.Println("Usage: ffs [mount|rebuild|scrub|gc|passwd|rekey|addkey|listkeys|revokekey] [options]")
 	flag.PrintDefaults()
 }
 
 // Init is called when the file system is created.
 func (fs *ffs) Init() {
 	log.Printf("Init Called \n")
+	go fs.syncMetadataEvery(fs.metaInterval)
+	go fs.dedupEvery(dedupInterval)
+	if fs.rekeyPending() {
+		go func() {
+			if err := fs.rekey(time.Minute); err != nil {
+				log.Printf(nlib.BashFontColor_RED+"rekey failed: %s"+nlib.BashFontColor_RESET, err)
+			}
+		}()
+	}
 }
 
 // Destroy is called when the file system is destroyed.
 func (fs *ffs) Destroy() {
+	defer fs.synchronize()()
 	log.Printf("Destroy Called \n")
+	if err := fs.syncMetadata(); err != nil {
+		log.Printf(nlib.BashFontColor_RED+"metadata sync failed: %s"+nlib.BashFontColor_RESET, err)
+	}
 }
 
 // Statfs gets file system statistics.
@@ -103,16 +152,21 @@ func (fs *ffs) checkFolder(s string) {
 			os.MkdirAll(fullpath, 0700)
 		}
 	}
-	fullpath := filepath.Join(fs.csFolder, s)
-	if _, err := os.Stat(fullpath); os.IsNotExist(err) {
-		os.MkdirAll(fullpath, 0700)
+	for _, path := range fs.csFolders {
+		fullpath := filepath.Join(path, s)
+		if _, err := os.Stat(fullpath); os.IsNotExist(err) {
+			os.MkdirAll(fullpath, 0700)
+		}
 	}
 }
 
 func (fs *ffs) createFileName(rowid uint64) string {
-	folder := fs.getFolder4id(rowid)
-	fs.checkFolder(folder)
-	return filepath.Join(folder, fmt.Sprintf("%03d", rowid))
+	fs.checkFolder(fs.getFolder4id(rowid))
+	return fs.fileName(rowid)
+}
+
+func (fs *ffs) fileName(rowid uint64) string {
+	return filepath.Join(fs.getFolder4id(rowid), fmt.Sprintf("%03d", rowid))
 }
 
 func (fs *ffs) appendFile(filename string, bytes []byte) error {
@@ -129,68 +183,24 @@ func (fs *ffs) appendFile(filename string, bytes []byte) error {
 	return nil
 }
 
-func (fs *ffs) readParts(filename string, ofset int) map[int][]byte {
-	result := make(map[int][]byte)
-	blockIndex := math.Ceil(float64(ofset) / float64(fsBlockSize))
-
-	/*readLen := ofset % fsBlockSize
-	if readLen == 0 {
-		readLen = fsBlockSize
-	}
-	buff := make([]byte, readLen) */
-
-	bsizebuff := make([]byte, 10)
-	var bsize uint64
-	for i, path := range fs.folders {
-		fullpath := filepath.Join(path, fmt.Sprintf("%s.dat%d", filename, i))
-		fmt.Printf("- %s", fullpath)
-		f, _ := os.OpenFile(fullpath, os.O_RDONLY, os.ModePerm)
-		currentBlock := 0
-		for {
-			f.Read(bsizebuff)
-			//fmt.Printf("- %v", bsizebuff)
-			bsize, _ = binary.Uvarint(bsizebuff)
-			//fmt.Printf("- block %d\n", bsize)
-			if currentBlock == int(blockIndex) {
-				blockforRead := make([]byte, bsize)
-				f.Read(blockforRead)
-				result[i+1] = blockforRead
-				break
-			} else {
-				f.Seek(int64(bsize), 1)
-			}
-			currentBlock++
-		}
-	}
-	fullpath := filepath.Join(fs.csFolder, fmt.Sprintf("%s.sum", filename))
-	f, _ := os.OpenFile(fullpath, os.O_RDONLY, os.ModePerm)
-	currentBlock := 0
-	for {
-		f.Read(bsizebuff)
-		bsize, _ = binary.Uvarint(bsizebuff)
-		if currentBlock == int(blockIndex) {
-			blockforRead := make([]byte, bsize)
-			f.Read(blockforRead)
-			result[0] = blockforRead
-			break
-		} else {
-			f.Seek(int64(bsize), 1)
-		}
-		currentBlock++
-	}
-	return result
-}
 
-func (fs *ffs) truncateFile(filename string) {
-	for i, path := range fs.folders {
-		fullpath := filepath.Join(path, fmt.Sprintf("%s.dat%d", filename, i))
-		f, _ := os.OpenFile(fullpath, os.O_RDWR, 0666)
+func (fs *ffs) truncateFile(rowid uint64) {
+	for s := 0; s < fs.dataShards+fs.parityShards; s++ {
+		f, _ := os.OpenFile(fs.shardPath(rowid, s), os.O_RDWR, 0666)
 		defer f.Close()
 		f.Truncate(0)
 	}
-	f, _ := os.OpenFile(filepath.Join(fs.csFolder, filename+".sum"), os.O_RDWR, 0666)
-	defer f.Close()
-	f.Truncate(0)
+	fs.DB.Exec("delete from holes where rowid=?", rowid)
+	fs.DB.Exec("delete from slots where rowid=?", rowid)
+}
+
+// removeShards removes the shard files, the holes and the slots of rowid.
+func (fs *ffs) removeShards(rowid uint64) {
+	for s := 0; s < fs.dataShards+fs.parityShards; s++ {
+		os.Remove(fs.shardPath(rowid, s))
+	}
+	fs.DB.Exec("delete from holes where rowid=?", rowid)
+	fs.DB.Exec("delete from slots where rowid=?", rowid)
 }
 
 /*
@@ -203,6 +213,7 @@ func (fs *ffs) Mknod(path string, mode uint32, dev uint64) int {
 
 // Mkdir creates a directory.
 func (fs *ffs) Mkdir(path string, mode uint32) int {
+	defer fs.synchronize()()
 	_, e := fs.DB.Exec("insert into items(parentid,name,fsize,isFolder,fullpath,cdate,mdate) VALUES (?,?,?,?,?,?,?)", fs.findPathID(path), filepath.Base(path), 0, true, path, time.Now(), time.Now())
 	if e != nil {
 		log.Println(e)
@@ -212,20 +223,23 @@ func (fs *ffs) Mkdir(path string, mode uint32) int {
 
 // Unlink removes a file.
 func (fs *ffs) Unlink(path string) int {
+	defer fs.synchronize()()
 	log.Printf("Unlink Called \n")
 	var rowid int
 	fs.DB.QueryRow("select rowid from items where fullpath=? and isFolder=false", path).Scan(&rowid)
+	fs.touch(uint64(rowid))
 
 	fs.DB.Exec("delete from items where rowid=?", rowid)
-	filename := fs.createFileName(uint64(rowid))
-	for i, path := range fs.folders {
-		os.Remove(filepath.Join(path, fmt.Sprintf("%s.dat%d", filename, i)))
-	}
+	fs.releaseChunks(uint64(rowid))
+	fs.releasePacked(uint64(rowid))
+	fs.DB.Exec("delete from dedups where rowid=?", rowid)
+	fs.removeShards(uint64(rowid))
 	return 0
 }
 
 // Rmdir removes a directory.
 func (fs *ffs) Rmdir(path string) int {
+	defer fs.synchronize()()
 	fs.DB.Exec("delete from items where fullpath=? and isFolder=true", path)
 	return 0
 }
@@ -250,12 +264,14 @@ func (fs *ffs) Readlink(path string) (int, string) {
 
 // Rename renames a file.
 func (fs *ffs) Rename(oldpath string, newpath string) int {
+	defer fs.synchronize()()
 	fs.DB.Exec("update items set name=?,fullpath=?,parentid=? where fullpath=?", filepath.Base(newpath), newpath, fs.findPathID(newpath), oldpath)
 	return 0
 }
 
 // Chmod changes the permission bits of a file.
 func (fs *ffs) Chmod(path string, mode uint32) int {
+	defer fs.synchronize()()
 	if val, ok := openFiles[path]; ok {
 		val.Mode = mode
 		openFiles[path] = val
@@ -281,20 +297,80 @@ func (fs *ffs) Utimens(path string, tmsp []fuse.Timespec) int {
 // Open opens a file.
 // The flags are a combination of the fuse.O_* constants.
 func (fs *ffs) Open(path string, flags int) (int, uint64) {
+	defer fs.synchronize()()
 	log.Printf(nlib.BashFontColor_GREEN+"Open Called %s FLAG: %d \n"+nlib.BashFontColor_RESET, path, flags)
+	write := flags&fuse.O_ACCMODE != fuse.O_RDONLY
+	if write && flags&fuse.O_TRUNC != 0 {
+		if errc := fs.resizeFile(path, ^uint64(0), 0); errc != 0 {
+			return errc, 0
+		}
+	}
+	// the handles of a path share its state, see Release
+	file, open := openFiles[path]
+	if !open {
+		var errc int
+		if file, errc = fs.openFile(path); errc != 0 {
+			return errc, 0
+		}
+	}
+	if write && file.Kind == 1 {
+		file.Kind = 0
+	}
+	file.Handles++
+	openFiles[path] = file
+	return 0, newHandle(uint64(file.ID), flags)
+}
+
+// newHandle returns a new handle of file rowid opened with flags.
+func newHandle(rowid uint64, flags int) uint64 {
+	lastHandle++
+	openHandles[lastHandle] = openHandle{rowid: rowid, write: flags&fuse.O_ACCMODE != fuse.O_RDONLY, append: flags&fuse.O_APPEND != 0}
+	return lastHandle
+}
+
+// openFile returns the state of an open file for path, opened for reading.
+func (fs *ffs) openFile(path string) (ffs_File, int) {
 	var rowid uint64
 	var fsize uint64
-	err := fs.DB.QueryRow("select rowid,fsize from items where fullpath=?", path).Scan(&rowid, &fsize)
+	var chunksize int
+	var keygen int
+	var filekey []byte
+	var format int
+	var deduped, packed bool
+	var inline []byte
+	err := fs.DB.QueryRow("select rowid,fsize,chunksize,keygen,filekey,format,deduped,packed,inline from items where fullpath=?", path).Scan(&rowid, &fsize, &chunksize, &keygen, &filekey, &format, &deduped, &packed, &inline)
 	if err != nil {
 		fmt.Printf("open err %s\n", path)
-		return -fuse.ENOENT, 0 //No such file or directory
+		return ffs_File{}, -fuse.ENOENT //No such file or directory
+	}
+	if deduped {
+		return ffs_File{ID: int64(rowid), Size: int64(fsize), Name: filepath.Base(path), Kind: 1, ChunkSize: chunksize, Stored: int64(fsize), Stripe: -1, Chunk: -1, Manifest: true}, 0
+	}
+	if packed {
+		return ffs_File{ID: int64(rowid), Size: int64(fsize), Name: filepath.Base(path), Kind: 1, ChunkSize: chunksize, Stored: int64(fsize), Stripe: -1, Chunk: -1, Packed: true}, 0
+	}
+	fc, err := fs.fileCrypt(rowid, keygen, filekey, format)
+	if err != nil {
+		log.Printf(nlib.BashFontColor_RED+"open of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+		return ffs_File{}, -fuse.EIO
 	}
-	openFiles[path] = ffs_File{ID: int64(rowid), Size: int64(fsize), Name: filepath.Base(path), Kind: 1}
-	return 0, rowid
+	fc.compress = fs.compressionFor(path)
+	fs.touch(rowid)
+	file := ffs_File{ID: int64(rowid), Size: int64(fsize), Name: filepath.Base(path), Kind: 1, ChunkSize: chunksize, Stored: int64(fsize), Stripe: -1, Chunk: -1, Crypt: fc}
+	if inline != nil {
+		data, err := openInline(fc, inline)
+		if err != nil {
+			log.Printf(nlib.BashFontColor_RED+"open of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return ffs_File{}, -fuse.EIO
+		}
+		file.Buf, file.Stripe, file.Stored, file.Inline = data, 0, 0, true
+	}
+	return file, 0
 }
 
 // Getattr gets file attributes.
 func (fs *ffs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
+	defer fs.synchronize()()
 	//fmt.Printf(nlib.BashFontColor_RED+"Getattr Called  %s \n"+nlib.BashFontColor_RESET, path)
 	var rowid uint64
 	if path == "/" || path == "." || path == ".." {
@@ -318,17 +394,18 @@ func (fs *ffs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
 	} else {
 		var fsize int64
 		var isFolder bool
-		if ^uint64(0) == fh {
-			err := fs.DB.QueryRow("select fsize,isFolder,rowid from items where fullpath=?", path).Scan(&fsize, &isFolder, &rowid)
+		var chunksize int
+		if h, ok := openHandles[fh]; ok {
+			rowid = h.rowid
+			err := fs.DB.QueryRow("select fsize,isFolder,chunksize from items where rowid=?", rowid).Scan(&fsize, &isFolder, &chunksize)
 			if err != nil {
-				fmt.Printf("get attr err1 %s\n", path)
+				fmt.Printf("get attr err2\n")
 				return -fuse.ENOENT //No such file or directory
 			}
 		} else {
-			rowid = fh
-			err := fs.DB.QueryRow("select fsize,isFolder from items where rowid=?", fh).Scan(&fsize, &isFolder)
+			err := fs.DB.QueryRow("select fsize,isFolder,rowid,chunksize from items where fullpath=?", path).Scan(&fsize, &isFolder, &rowid, &chunksize)
 			if err != nil {
-				fmt.Printf("get attr err2\n")
+				fmt.Printf("get attr err1 %s\n", path)
 				return -fuse.ENOENT //No such file or directory
 			}
 		}
@@ -347,6 +424,12 @@ func (fs *ffs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
 		} else {
 			if val, ok := openFiles[path]; ok {
 				stat.Mode = val.Mode
+				if stat.Mode == 0 {
+					stat.Mode = 33206
+				}
+				stat.Size = val.Size
+				stat.Blksize = 4096
+				stat.Blocks = fs.storedBlocks(rowid, val.Size, val.ChunkSize)
 				return 0
 			} else {
 				stat.Mode = 33206 //fuse.S_IFREG | 0444
@@ -354,7 +437,7 @@ func (fs *ffs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
 
 			stat.Size = fsize
 			stat.Blksize = 4096
-			//stat.Blocks = 1
+			stat.Blocks = fs.storedBlocks(rowid, fsize, chunksize)
 		}
 	}
 	//fmt.Printf("%#v \n", stat)
@@ -364,115 +447,248 @@ func (fs *ffs) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
 // Read reads data from a file.
 func (fs *ffs) Read(path string, buff []byte, ofst int64, fh uint64) int {
 	//log.Printf(nlib.BashFontColor_YELLOW+"Read Called %s offset %d fh %d \n"+nlib.BashFontColor_RESET, path, ofst, fh)
-	/*
-		parts := fs.readParts(fs.createFileName(fh), int(ofst))
-		part1 := nlib.Decrypt(parts[1], enckey)
-		part2 := nlib.Decrypt(parts[2], enckey)
-		return copy(buff, append(part1, part2...))
-	*/ //REad Parted
+	defer fs.synchronize()()
 	file := openFiles[path]
-	//log.Printf("File size : %d fileData : %d", file.Size, len(file.Data))
-	if len(file.Data) < 1 {
-		log.Printf(nlib.BashFontColor_YELLOW+"Real Read  %s \n"+nlib.BashFontColor_RESET, path)
-		filename := fs.createFileName(fh)
-		for i, folder := range fs.folders {
-			fullpath := filepath.Join(folder, fmt.Sprintf("%s.dat%d", filename, i))
-			encBytes, err := ioutil.ReadFile(fullpath)
-			log.Printf("file read %s %d %v\n", fullpath, len(encBytes), err)
-			if err == nil {
-				openData := nlib.Decrypt(encBytes, enckey)
-				log.Printf("Decrypt ... openData : %d", len(openData))
-				file.Data = append(file.Data, openData...)
-				//log.Printf("file decrypted\n")
-			} else {
-				//checksum'a git
-				log.Printf("--- Hata var %s", err)
+	if file.Packed {
+		if !file.Loaded {
+			data, err := fs.readPacked(uint64(file.ID))
+			if err != nil {
+				log.Printf(nlib.BashFontColor_RED+"read of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+				return -fuse.EIO
 			}
-			log.Printf("Reading ... File size : %d fileData : %d", file.Size, len(file.Data))
+			file.Data, file.Loaded = data, true
+			openFiles[path] = file
 		}
-		if int(file.Size) < len(file.Data) {
-			file.Data = file.Data[:file.Size]
+		if ofst >= int64(len(file.Data)) {
+			return 0
 		}
+		return copy(buff, file.Data[ofst:])
+	}
+	if file.Manifest {
+		n, err := fs.readChunksAt(&file, buff, ofst)
 		openFiles[path] = file
+		if err != nil {
+			log.Printf(nlib.BashFontColor_RED+"read of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+		return n
+	}
+	if file.ChunkSize > 0 {
+		n, err := fs.readAt(&file, buff, ofst)
+		openFiles[path] = file
+		if err != nil {
+			log.Printf(nlib.BashFontColor_RED+"read of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+		return n
+	}
+	//log.Printf("File size : %d fileData : %d", file.Size, len(file.Data))
+	if !file.Loaded {
+		if err := fs.loadFile(&file, uint64(file.ID)); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"read of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+		openFiles[path] = file
+	}
+	if ofst >= int64(len(file.Data)) {
+		return 0
 	}
 	lastbyte := int(ofst) + len(buff)
-	log.Printf("file read %s offset %d lastbyte %d\n", path, ofst, lastbyte)
-	log.Printf("File size : %d fileData : %d", file.Size, len(file.Data))
-	log.Printf("Len1 %d Len2 %d \n", len(buff), len(file.Data[ofst:lastbyte]))
-
-	copied := copy(buff, file.Data[ofst:lastbyte])
-	log.Printf("file read %s offset %d lastbyte %d copied %d\n", path, ofst, lastbyte, copied)
-	return copied
+	if lastbyte > len(file.Data) {
+		lastbyte = len(file.Data)
+	}
+	return copy(buff, file.Data[ofst:lastbyte])
 }
 
 // Truncate changes the size of a file.
 func (fs *ffs) Truncate(path string, size int64, fh uint64) int {
+	defer fs.synchronize()()
 	log.Printf("Truncate Called %s, size:%d, rec:%d \n", path, size, fh)
-	_, err := fs.DB.Exec("update items set fsize=? where rowid=?", size, fh)
+	rowid := ^uint64(0)
+	if h, ok := openHandles[fh]; ok {
+		rowid = h.rowid
+	}
+	return fs.resizeFile(path, rowid, size)
+}
+
+// resizeFile makes the file at path size bytes long, rowid is ^uint64(0)
+// when it is not known. An open file keeps its handles.
+func (fs *ffs) resizeFile(path string, rowid uint64, size int64) int {
+	if size < 0 {
+		return -fuse.EINVAL
+	}
+	if ^uint64(0) == rowid {
+		if err := fs.DB.QueryRow("select rowid from items where fullpath=? and isFolder=false", path).Scan(&rowid); err != nil {
+			fmt.Printf("truncate err %s\n", path)
+			return -fuse.ENOENT //No such file or directory
+		}
+	}
+	fs.touch(rowid)
+	var deduped, packed bool
+	fs.DB.QueryRow("select deduped,packed from items where rowid=?", rowid).Scan(&deduped, &packed)
+	if deduped {
+		file, open := openFiles[path]
+		if !open {
+			var errc int
+			if file, errc = fs.openFile(path); errc != 0 {
+				return errc
+			}
+		}
+		if err := fs.resizeChunks(&file, path, size); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"truncate of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+		if open {
+			openFiles[path] = file
+		}
+		return 0
+	}
+	if packed {
+		if _, err := fs.unpackFile(rowid, path); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"truncate of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+	}
+	file, open := openFiles[path]
+	if !open || file.Packed {
+		fresh, errc := fs.openFile(path)
+		if errc != 0 {
+			return errc
+		}
+		if open {
+			fresh.Mode, fresh.Kind, fresh.Written = file.Mode, file.Kind, file.Written
+			fresh.Handles = file.Handles
+		}
+		file = fresh
+	}
+	if size == file.Size {
+		return 0
+	}
+	if file.ChunkSize == 0 {
+		if err := fs.convertFile(&file); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"truncate of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+	}
+	var err error
+	if size > file.Size {
+		// the new stripes are holes, see ffs_sparse.go
+		err = fs.extendFile(&file, size)
+	} else {
+		err = fs.shrinkFile(&file, size)
+	}
 	if err != nil {
-		fmt.Printf("truncate err")
+		log.Printf(nlib.BashFontColor_RED+"truncate of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+		return -fuse.EIO
+	}
+	if open {
+		openFiles[path] = file
 	}
-	filename := fs.createFileName(fh)
-	fs.truncateFile(filename)
 	return 0
 }
 
 // Create creates and opens a file.
 // The flags are a combination of the fuse.O_* constants.
 func (fs *ffs) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+	defer fs.synchronize()()
 	log.Printf("Create called %s flags : %d , mode : %d \n", path, flags, mode)
-	res, e := fs.DB.Exec("insert into items(parentid,name,fsize,isFolder,fullpath,cdate,mdate) VALUES (?,?,?,?,?,?,?)", fs.findPathID(path), filepath.Base(path), 0, false, path, time.Now(), time.Now())
+	keys := fs.currentKeys()
+	res, e := fs.DB.Exec("insert into items(parentid,name,fsize,isFolder,fullpath,cdate,mdate,chunksize,sumenc,keygen) VALUES (?,?,?,?,?,?,?,?,1,?)", fs.findPathID(path), filepath.Base(path), 0, false, path, time.Now(), time.Now(), fs.chunkSize, keys.gen)
 	if e != nil {
 		log.Println(e)
 	}
 	fhi, _ := res.LastInsertId()
-	openFiles[path] = ffs_File{ID: fhi, Size: 0, Name: filepath.Base(path), Kind: 2, Mode: mode}
-	return 0, uint64(fhi)
+	fc, err := fs.newFileCrypt(uint64(fhi), keys)
+	if err != nil {
+		log.Printf(nlib.BashFontColor_RED+"create of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+		return -fuse.EIO, 0
+	}
+	fc.compress = fs.compressionFor(path)
+	fs.DB.Exec("update items set filekey=?,format=? where rowid=?", fc.wrapped, fc.format, fhi)
+	openFiles[path] = ffs_File{ID: fhi, Size: 0, Name: filepath.Base(path), Kind: 2, Mode: mode, ChunkSize: fs.chunkSize, Stripe: -1, Chunk: -1, Changed: true, Crypt: fc, Handles: 1}
+	// the handle of a new file writes whatever the access mode
+	return 0, newHandle(uint64(fhi), flags&^fuse.O_ACCMODE|fuse.O_RDWR)
 }
 
 // Write writes data to a file.
 func (fs *ffs) Write(path string, buff []byte, ofst int64, fh uint64) int {
 	//log.Printf(nlib.BashFontColor_RED+"Write Called ofst:%d,bsize:%d  \n"+nlib.BashFontColor_RESET, ofst, len(buff))
+	defer fs.synchronize()()
 	file := openFiles[path]
-	file.Data = append(file.Data, buff...)
-	openFiles[path] = file
-	log.Printf(nlib.BashFontColor_RED+"Write Called ofst:%d,bsize:%d DataLen: %d  \n"+nlib.BashFontColor_RESET, ofst, len(buff), len(file.Data))
+	defer func() {
+		openFiles[path] = file
+	}()
+	if !openHandles[fh].write {
+		return -fuse.EBADF // opened for reading only
+	}
+	if openHandles[fh].append {
+		ofst = file.Size
+	}
+	if file.Manifest {
+		// only the chunks the write falls in are replaced, see ffs_dedup.go
+		if err := fs.writeChunksAt(&file, path, buff, ofst); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"write to %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+		file.Changed = true
+		return len(buff)
+	}
+	if file.Packed {
+		fc, err := fs.unpackFile(uint64(file.ID), path)
+		if err != nil {
+			log.Printf(nlib.BashFontColor_RED+"write to %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+		file.Crypt, file.ChunkSize, file.Packed = fc, fs.chunkSize, false
+		file.Data, file.Loaded = nil, false
+	}
+	if file.ChunkSize == 0 {
+		if err := fs.convertFile(&file); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"write to %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+	}
+	if err := fs.writeAt(&file, buff, ofst); err != nil {
+		log.Printf(nlib.BashFontColor_RED+"write to %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+		return -fuse.EIO
+	}
+	file.Written = true
 	return len(buff)
 
 }
 
 // Flush flushes cached file data.
 func (fs *ffs) Flush(path string, fh uint64) int {
+	defer fs.synchronize()()
 	file := openFiles[path]
-	if file.Kind == 2 {
-		log.Printf(nlib.BashFontColor_YELLOW+"Real Write %s data:%d  \n"+nlib.BashFontColor_RESET, path, len(file.Data))
-		size := float64(len(file.Data))
-		partsize := int(math.Ceil(size / float64(len(fs.folders))))
-		filename := fs.createFileName(fh)
-		//bs := make([]byte, 10)
-		for i, folder := range fs.folders {
-			toWrite := nlib.Encrypt(file.Data[i*partsize:(i+1)*partsize], enckey)
-			//binary.PutUvarint(bs, uint64(len(toWrite)))
-			//toWrite = append(bs, toWrite...)
-			ioutil.WriteFile(filepath.Join(folder, fmt.Sprintf("%s.dat%d", filename, i)), toWrite, 0644)
-			//fs.appendFile(filepath.Join(folder, fmt.Sprintf("%s.dat%d", filename, i)), toWrite)
-		}
-
-		csum := make([]byte, partsize)
-
-		for i := 0; i < len(fs.folders); i++ {
-			if i == 0 {
-				csum = file.Data[i*partsize : (i+1)*partsize]
-			} else {
-				csum = nlib.XOR2Bytes(csum, file.Data[i*partsize:(i+1)*partsize])
+	if file.Manifest && file.Changed {
+		if err := fs.flushChunks(&file, path); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"flush of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+		fs.DB.Exec("update items set mdate=? where rowid=?", time.Now(), file.ID)
+		file.Changed = false
+		openFiles[path] = file
+		return 0
+	}
+	if file.Dirty || file.Changed {
+		log.Printf(nlib.BashFontColor_YELLOW+"Real Write %s size:%d  \n"+nlib.BashFontColor_RESET, path, file.Size)
+		if fs.inlines(&file) {
+			if err := fs.inlineFile(&file); err != nil {
+				log.Printf(nlib.BashFontColor_RED+"flush of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+				return -fuse.EIO
 			}
+			openFiles[path] = file
+			return 0
 		}
-		//binary.PutUvarint(bs, uint64(len(csum)))
-		//toWrite := append(bs, csum...)
-		//fs.appendFile(filepath.Join(fs.csFolder, fmt.Sprintf("%s.sum", filename)), toWrite)
-		//fs.appendFile(filepath.Join(fs.csFolder, fmt.Sprintf("%s.sum", filename)), csum)
-		ioutil.WriteFile(filepath.Join(fs.csFolder, fmt.Sprintf("%s.sum", filename)), csum, 0644)
-		fs.DB.Exec("update items set fsize=fsize+? where rowid=?", size, fh)
+		if err := fs.flushStripe(&file); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"flush of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+			return -fuse.EIO
+		}
+		fs.DB.Exec("update items set fsize=?,mdate=?,inline=null where rowid=?", file.Stored, time.Now(), file.ID)
+		file.Inline = false
+		file.Changed = false
+		openFiles[path] = file
 	}
 
 	log.Printf("Flush Called %s %d \n", path, fh)
@@ -481,6 +697,25 @@ func (fs *ffs) Flush(path string, fh uint64) int {
 
 // Release closes an open file.
 func (fs *ffs) Release(path string, fh uint64) int {
+	defer fs.synchronize()()
+	delete(openHandles, fh)
+	if file, ok := openFiles[path]; ok && file.Handles > 1 {
+		file.Handles--
+		openFiles[path] = file
+		log.Printf("Release Called \n")
+		return 0
+	}
+	if file, ok := openFiles[path]; ok && file.Manifest {
+		if err := fs.flushChunks(&file, path); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"flush of %s failed: %s"+nlib.BashFontColor_RESET, path, err)
+		}
+	}
+	if file, ok := openFiles[path]; ok && fs.dedup && file.Written && file.Stored > fs.packThreshold {
+		// the dedup worker cuts it in chunks once it is closed, see ffs_dedup.go
+		if err := fs.queueDedup(uint64(file.ID)); err != nil {
+			log.Printf(nlib.BashFontColor_RED+"dedup of %s is not queued: %s"+nlib.BashFontColor_RESET, path, err)
+		}
+	}
 	delete(openFiles, path)
 	log.Printf("Release Called \n")
 	return 0
@@ -543,8 +778,15 @@ func (fs *ffs) Fsyncdir(path string, datasync bool, fh uint64) int {
 
 // Setxattr sets extended attributes.
 func (fs *ffs) Setxattr(path string, name string, value []byte, flags int) int {
+	defer fs.synchronize()()
 	//log.Printf("Setxattr Called\n")
 	log.Printf("Setxattr Called path:%s name:%s value:%v flags:%d \n", path, name, value, flags)
+	if name == compressXattr {
+		if _, err := compressionByName(string(value)); err != nil {
+			log.Println(err)
+			return -fuse.EINVAL
+		}
+	}
 	_, e := fs.DB.Exec("INSERT OR REPLACE into items_ex(fullpath,name,value,flag) VALUES (?,?,?,?)", path, name, value, flags)
 	if e != nil {
 		log.Println(e)
@@ -555,6 +797,16 @@ func (fs *ffs) Setxattr(path string, name string, value []byte, flags int) int {
 // Getxattr gets extended attributes.
 func (fs *ffs) Getxattr(path string, name string) (int, []byte) {
 	log.Printf("Getxattr Called path %s name %s \n", path, name)
+	if name == holesXattr {
+		var rowid uint64
+		var fsize int64
+		var chunksize int
+		if err := fs.DB.QueryRow("select rowid,fsize,chunksize from items where fullpath=? and isFolder=false", path).Scan(&rowid, &fsize, &chunksize); err != nil {
+			log.Println(err)
+			return -fuse.ENOENT, nil
+		}
+		return 0, []byte(fs.holeList(rowid, fsize, chunksize))
+	}
 	var val []byte
 	e := fs.DB.QueryRow("select value from items_ex where fullpath=? AND name=? ", path, name).Scan(&val)
 	if e != nil {
@@ -566,6 +818,7 @@ func (fs *ffs) Getxattr(path string, name string) (int, []byte) {
 
 // Removexattr removes extended attributes.
 func (fs *ffs) Removexattr(path string, name string) int {
+	defer fs.synchronize()()
 	_, e := fs.DB.Exec("DELETE from items_ex WHERE fullpath=? AND name=? ", path, name)
 	if e != nil {
 		log.Println(e)
@@ -589,8 +842,8 @@ func (fs *ffs) Listxattr(path string, fill func(name string) bool) int {
 
 //Creates Empty SQLiteDB
 func (fs *ffs) CreateDb() {
-	fs.DB, _ = sql.Open("sqlite3", filepath.Join(fs.folders[0], "/.mfs_db"))
-	fs.DB.Exec("CREATE TABLE IF NOT EXISTS items (parentid INTEGER,name TEXT, fsize INTEGER,isFolder bool,fullpath string,cdate datetime, mdate datetime,mode integer,UNIQUE(fullpath))")
+	fs.DB, _ = sql.Open("sqlite3", fs.dbFile)
+	fs.DB.Exec("CREATE TABLE IF NOT EXISTS items (parentid INTEGER,name TEXT, fsize INTEGER,isFolder bool,fullpath string,cdate datetime, mdate datetime,mode integer,sumenc integer default 0,chunksize integer default 0,keygen integer default 0,filekey blob,deduped integer default 0,packed integer default 0,inline blob,format integer default 0,UNIQUE(fullpath))")
 	fs.DB.Exec("CREATE TABLE IF NOT EXISTS items_ex (fullpath TEXT,name TEXT, value BLOB,flag integer,UNIQUE(fullpath,name))")
 	fs.DB.Exec("CREATE INDEX IF NOT EXISTS ix_items_parentid ON items(parentid)")
 	fs.DB.Exec("CREATE INDEX IF NOT EXISTS ix_items_fullpath ON items(fullpath)")
@@ -606,48 +859,250 @@ func init() {
 func main() {
 	openFiles = make(map[string]ffs_File)
 
+	command := "mount"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
 	var mountPoint string
-	var checksumdir string
+	var checksumdirs ffs_LocalFolder
+	var parityShards int
+	var layout string
 	var password string
+	var newPassword string
+	var keyfile string
+	var newKeyfile string
+	var passwordEnv string
+	var newPasswordEnv string
+	var passwordCommand string
+	var newPasswordCommand string
+	var slotName string
+	var slotID int
 	var dataFolders ffs_LocalFolder
+	var sourceIndex int
+	var checksumIndex int
+	var target string
+	var reportFile string
+	var repair bool
+	var writeBuffer int
+	var metaSync int
+	var cacheDir string
+	var compress string
+	var dedup string
+	var packThreshold int
+	var inlineThreshold int
 
 	flag.StringVar(&mountPoint, "mountpoint", "", "Mount Folder")
-	flag.StringVar(&checksumdir, "checksumdir", "", "CheckSum Store Folder")
+	flag.Var(&checksumdirs, "checksumdir", "CheckSum Store Folders, parity shards are spread over them --checksumdir X/Z")
+	flag.IntVar(&parityShards, "parity-shards", 0, "Number of parity shards of a new volume (default one per --checksumdir)")
+	flag.StringVar(&layout, "layout", "dedicated", "Parity layout of a new volume: dedicated (parity in --checksumdir) or rotating (parity spread over the sources)")
 	flag.Var(&dataFolders, "source", "Multiple Data Store Folders --source X/X/ --source X/Y")
-	flag.StringVar(&password, "password", "--ffs2021.06.21MFS", "Password for encryption")
-	flag.Parse()
-	if len(flag.CommandLine.Args()) < 1 {
+	flag.IntVar(&writeBuffer, "write-buffer", 4, "Megabytes every open file buffers before it is written to the sources, fixed when the volume is created")
+	flag.IntVar(&metaSync, "meta-sync", 30, "Seconds between the metadata replica syncs while mounted")
+	flag.StringVar(&compress, "compress", "", "Compression of the volume: none, gzip or zstd, folders and files can override it with the user.ffs.compress xattr (default kept, none for new volumes)")
+	flag.StringVar(&dedup, "dedup", "", "Store written files in content defined chunks, identical chunks of all files once: on or off (default kept, off for new volumes)")
+	flag.IntVar(&packThreshold, "pack-threshold", -1, "Kilobytes up to which files are packed together instead of having shards of their own, 0 turns packing off (default kept, 64 for new volumes)")
+	flag.IntVar(&inlineThreshold, "inline-threshold", -1, "Bytes up to which files are kept in the metadata database instead of the sources, 0 turns it off (default kept, 2048 for new volumes)")
+	flag.StringVar(&cacheDir, "cache-dir", "", "Local folder of the metadata database, the sources only keep encrypted replicas (default the user cache folder)")
+	flag.StringVar(&password, "password", "", "Password of the volume, visible to everyone on the host (default asked on the terminal)")
+	flag.StringVar(&keyfile, "keyfile", "", "File whose content unlocks the volume instead of --password")
+	flag.StringVar(&passwordEnv, "password-env", "", "Environment variable that holds the password")
+	flag.StringVar(&passwordCommand, "password-command", "", "Shell command that prints the password, like a secret store client")
+	flag.StringVar(&newPassword, "new-password", "", "passwd, addkey: New password of the key slot (default asked on the terminal)")
+	flag.StringVar(&newKeyfile, "new-keyfile", "", "passwd, addkey: Keyfile of the key slot instead of --new-password")
+	flag.StringVar(&newPasswordEnv, "new-password-env", "", "passwd, addkey: Environment variable that holds the new password")
+	flag.StringVar(&newPasswordCommand, "new-password-command", "", "passwd, addkey: Shell command that prints the new password")
+	flag.StringVar(&slotName, "slot-name", "", "addkey: Name of the new key slot, like its owner")
+	flag.IntVar(&slotID, "slot", -1, "revokekey: Id of the key slot to revoke, listkeys shows them")
+	flag.IntVar(&sourceIndex, "source-index", -1, "rebuild: Index of the --source folder to regenerate (0 is the first --source)")
+	flag.IntVar(&checksumIndex, "checksum-index", -1, "rebuild: Index of the --checksumdir folder to regenerate")
+	flag.StringVar(&target, "target", "", "rebuild: Empty folder that replaces the lost source")
+	flag.StringVar(&reportFile, "report", "", "scrub: Write the JSON report to this file instead of stdout")
+	flag.BoolVar(&repair, "repair", false, "scrub: Rewrite broken parts and checksums from the good ones")
+	flag.CommandLine.Parse(args)
+	if len(os.Args) < 2 {
 		usage()
 		return
 	}
-	enckey = []byte(nlib.GetMD5Hash(password))
 
 	if len(dataFolders) < 2 {
 		log.Fatal("You must enter minimum 2 sources")
 	}
-	if len(mountPoint) < 1 {
-		log.Fatal("You must enter mountpoint")
-	}
-	if len(checksumdir) < 1 {
-		log.Fatal("You must enter checksumdir")
-	}
 
 	u, _ := user.Current()
 	gid, _ := strconv.Atoi(u.Gid)
 	uid, _ := strconv.Atoi(u.Uid)
-	fs := ffs{gid: uint32(gid), uid: uint32(uid), csFolder: checksumdir, folders: dataFolders}
+	fs := ffs{gid: uint32(gid), uid: uint32(uid), csFolders: checksumdirs, folders: dataFolders}
 
-	log.Printf("%#v", fs)
+	log.Printf("%#v", &fs)
 
-	dbfile := filepath.Join(fs.folders[0], "/.mfs_db")
-	if _, err := os.Stat(dbfile); os.IsNotExist(err) {
-		fs.CreateDb()
-	} else {
-		fs.DB, err = sql.Open("sqlite3", dbfile)
+	switch command {
+	case "mount":
+		if len(mountPoint) < 1 {
+			log.Fatal("You must enter mountpoint")
+		}
+	case "rebuild":
+		if checksumIndex >= 0 && checksumIndex < len(checksumdirs) {
+			sourceIndex = len(dataFolders) + checksumIndex
+		} else if sourceIndex < 0 || sourceIndex >= len(dataFolders) {
+			log.Fatalf("--source-index must be between 0 and %d or --checksum-index between 0 and %d", len(dataFolders)-1, len(checksumdirs)-1)
+		}
+		if len(target) < 1 {
+			log.Fatal("You must enter target")
+		}
+	case "scrub", "gc", "rekey":
+	case "passwd", "addkey":
+	case "revokekey":
+		if slotID < 0 {
+			log.Fatal("You must enter slot")
+		}
+	case "listkeys":
+		if err := fs.listKeySlots(os.Stdout); err != nil {
+			log.Fatalf("Key Error: %s\n", err)
+		}
+		return
+	default:
+		usage()
+		return
+	}
+
+	fs.cacheDir = cacheDir
+	if fs.cacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			dir = os.TempDir()
+		}
+		fs.cacheDir = filepath.Join(dir, "ffs")
+	}
+	fs.metaInterval = time.Duration(metaSync) * time.Second
+	provider, err := newKeyProvider(password, keyfile, passwordEnv, passwordCommand, promptKey{prompt: "Password"})
+	if err != nil {
+		log.Fatalf("Key Error: %s\n", err)
+	}
+	if password, err = provider.secret(); err != nil {
+		log.Fatalf("Key Error: %s (volumes of older versions without a password use --password=--ffs2021.06.21MFS)\n", err)
+	}
+	if command == "passwd" || command == "addkey" {
+		provider, err := newKeyProvider(newPassword, newKeyfile, newPasswordEnv, newPasswordCommand, promptKey{prompt: "New password", confirm: true})
 		if err != nil {
-			log.Fatalf("Database Error 1003: %s\n", err)
+			log.Fatalf("Key Error: %s\n", err)
+		}
+		if newPassword, err = provider.secret(); err != nil {
+			log.Fatalf("Key Error: %s\n", err)
 		}
 	}
+	if err := fs.unlockVolume(password); err != nil {
+		log.Fatalf("Key Error: %s\n", err)
+	}
+	created, err := fs.openDb(command == "mount")
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := fs.setupVolume(created, layout, parityShards, writeBuffer); err != nil {
+		log.Fatalf("Volume Error: %s\n", err)
+	}
+	if len(compress) > 0 {
+		if err := fs.setCompression(compress); err != nil {
+			log.Fatalf("Volume Error: %s\n", err)
+		}
+	}
+	if len(dedup) > 0 {
+		if err := fs.setDedup(dedup); err != nil {
+			log.Fatalf("Volume Error: %s\n", err)
+		}
+	}
+	if packThreshold >= 0 {
+		if err := fs.setPackThreshold(packThreshold); err != nil {
+			log.Fatalf("Volume Error: %s\n", err)
+		}
+	}
+	if inlineThreshold >= 0 {
+		if err := fs.setInlineThreshold(inlineThreshold); err != nil {
+			log.Fatalf("Volume Error: %s\n", err)
+		}
+	}
+	skip := -1
+	if command == "rebuild" {
+		skip = sourceIndex
+	}
+	if err := fs.checkSuperblocks(skip); err != nil {
+		log.Fatalf("Volume Error: %s\n", err)
+	}
+	if err := fs.syncMetadata(); err != nil {
+		log.Fatalf("Metadata Error: %s\n", err)
+	}
+
+	if command == "rebuild" {
+		err := fs.rebuild(sourceIndex, target)
+		fs.syncMetadata()
+		if err != nil {
+			log.Fatalf("Rebuild failed: %s\n", err)
+		}
+		return
+	}
+	if command == "gc" {
+		_, err := fs.dedupQueued()
+		if err == nil {
+			err = fs.collectChunks()
+		}
+		if err == nil {
+			err = fs.gcPacks()
+		}
+		fs.syncMetadata()
+		if err != nil {
+			log.Fatalf("gc failed: %s\n", err)
+		}
+		return
+	}
+	if command == "passwd" {
+		if err := fs.changePassword(newPassword); err != nil {
+			log.Fatalf("Key Error: %s\n", err)
+		}
+		return
+	}
+	if command == "addkey" {
+		if err := fs.addKeySlot(slotName, newPassword); err != nil {
+			log.Fatalf("Key Error: %s\n", err)
+		}
+		return
+	}
+	if command == "revokekey" {
+		if err := fs.revokeKeySlot(slotID); err != nil {
+			log.Fatalf("Key Error: %s\n", err)
+		}
+		return
+	}
+	if command == "rekey" {
+		if fs.rekeyPending() {
+			log.Printf("Resuming rekey to key generation %d \n", fs.currentKeys().gen)
+		} else if err := fs.startRekey(password); err != nil {
+			log.Fatalf("Key Error: %s\n", err)
+		}
+		err := fs.rekey(time.Second)
+		fs.syncMetadata()
+		if err != nil {
+			log.Fatalf("Rekey failed: %s\n", err)
+		}
+		return
+	}
+	if command == "scrub" {
+		report := os.Stdout
+		if len(reportFile) > 0 {
+			f, err := os.Create(reportFile)
+			if err != nil {
+				log.Fatalf("Report Error: %s\n", err)
+			}
+			defer f.Close()
+			report = f
+		}
+		err := fs.scrub(report, repair)
+		fs.syncMetadata()
+		if err != nil {
+			log.Fatalf("Scrub: %s\n", err)
+		}
+		return
+	}
 
 	_host := fuse.NewFileSystemHost(&fs)
 	_host.Mount(mountPoint, []string{"-o", "defer_permissions", "-o", "noappledouble", "-o", "volname=ffs-" + filepath.Base(mountPoint)}) // []string{"-d"})
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/billziss-gh/cgofuse/fuse"
+)
+
+// newTestFS creates a volume of n sources and a checksum folder in a
+// temporary folder.
+func newTestFS(t *testing.T, n int) *ffs {
+	dir := t.TempDir()
+	openFiles = make(map[string]ffs_File)
+	fs := &ffs{csFolders: []string{filepath.Join(dir, "cs")}}
+	for i := 0; i < n; i++ {
+		fs.folders = append(fs.folders, filepath.Join(dir, string(rune('a'+i))))
+		os.MkdirAll(fs.folders[i], 0700)
+	}
+	os.MkdirAll(fs.csFolders[0], 0700)
+	fs.cacheDir = filepath.Join(dir, "cache")
+	if err := fs.unlockVolume("pw"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.openDb(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.setupVolume(true, "dedicated", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	fs.inlineThreshold = 0
+	return fs
+}
+
+// writeFile creates the file at path with data and returns its rowid.
+func writeFile(t *testing.T, fs *ffs, path string, data []byte) uint64 {
+	errc, fh := fs.Create(path, 0, 0644)
+	if errc != 0 {
+		t.Fatalf("create %s: %d", path, errc)
+	}
+	if n := fs.Write(path, data, 0, fh); n != len(data) {
+		t.Fatalf("write %s: %d", path, n)
+	}
+	if errc := fs.Flush(path, fh); errc != 0 {
+		t.Fatalf("flush %s: %d", path, errc)
+	}
+	rowid := openHandles[fh].rowid
+	fs.Release(path, fh)
+	return rowid
+}
+
+// readAll reads the file at path through FUSE sized reads.
+func readAll(t *testing.T, fs *ffs, path string) []byte {
+	errc, fh := fs.Open(path, 0)
+	if errc != 0 {
+		t.Fatalf("open %s: %d", path, errc)
+	}
+	defer fs.Release(path, fh)
+	var out []byte
+	buf := make([]byte, 4096)
+	for {
+		n := fs.Read(path, buf, int64(len(out)), fh)
+		if n < 0 {
+			t.Fatalf("read %s: %d", path, n)
+		}
+		if n == 0 {
+			return out
+		}
+		out = append(out, buf[:n]...)
+	}
+}
+
+// TestOpenFlags checks O_RDONLY, O_TRUNC and O_APPEND, and that the access
+// mode and O_APPEND belong to the handle they were opened with.
+func TestOpenFlags(t *testing.T) {
+	fs := newTestFS(t, 3)
+	writeFile(t, fs, "/f", []byte("0123456789"))
+
+	_, h := fs.Open("/f", fuse.O_RDONLY)
+	if fs.Write("/f", []byte("x"), 0, h) != -fuse.EBADF {
+		t.Fatal("write to a read only handle")
+	}
+	fs.Release("/f", h)
+
+	_, h = fs.Open("/f", fuse.O_RDONLY|fuse.O_TRUNC)
+	fs.Release("/f", h)
+	if got := readAll(t, fs, "/f"); string(got) != "0123456789" {
+		t.Fatal("O_TRUNC of a read only open", string(got))
+	}
+	_, h = fs.Open("/f", fuse.O_WRONLY|fuse.O_TRUNC)
+	fs.Write("/f", []byte("new"), 0, h)
+	fs.Flush("/f", h)
+	fs.Release("/f", h)
+	if got := readAll(t, fs, "/f"); string(got) != "new" {
+		t.Fatal("O_TRUNC", string(got))
+	}
+	if errc, _ := fs.Open("/none", fuse.O_WRONLY|fuse.O_TRUNC); errc != -fuse.ENOENT {
+		t.Fatal("O_TRUNC of a missing file", errc)
+	}
+
+	_, app := fs.Open("/f", fuse.O_WRONLY|fuse.O_APPEND)
+	_, plain := fs.Open("/f", fuse.O_RDWR)
+	if app == plain {
+		t.Fatal("two opens share a handle")
+	}
+	fs.Write("/f", []byte("N"), 0, plain)
+	fs.Write("/f", []byte("++"), 0, app)
+	fs.Write("/f", []byte("!"), 1, plain)
+	fs.Release("/f", app)
+	buf := make([]byte, 16)
+	if n := fs.Read("/f", buf, 0, plain); !bytes.Equal(buf[:n], []byte("N!w++")) {
+		t.Fatal("shared state", string(buf[:n]))
+	}
+	fs.Flush("/f", plain)
+	fs.Release("/f", plain)
+	if got := readAll(t, fs, "/f"); string(got) != "N!w++" || len(openFiles) != 0 {
+		t.Fatal("O_APPEND per handle", string(got), len(openFiles))
+	}
+	if _, ok := openHandles[app]; ok {
+		t.Fatal("released handle is kept")
+	}
+	// the access mode belongs to the handle too
+	_, ro := fs.Open("/f", fuse.O_RDONLY)
+	_, rw := fs.Open("/f", fuse.O_RDWR)
+	if fs.Write("/f", []byte("X"), 0, ro) != -fuse.EBADF {
+		t.Fatal("write through a read only handle of a file open for writing")
+	}
+	fs.Release("/f", ro)
+	fs.Flush("/f", rw)
+	fs.Release("/f", rw)
+	if got := readAll(t, fs, "/f"); string(got) != "N!w++" {
+		t.Fatal("read only handle wrote", string(got))
+	}
+}